@@ -28,7 +28,7 @@ func main() {
 			return obj.(*v1.Pod).CreationTimestamp.String()
 		},
 	}
-	indexer, err := sqlcache.NewCustomListOptionIndexer(&v1.Pod{}, cache.DeletionHandlingMetaNamespaceKeyFunc, "pods.sqlite", fieldFuncs, cache.Indexers{})
+	indexer, err := sqlcache.NewListOptionIndexer(&v1.Pod{}, "pods.sqlite", fieldFuncs)
 	if err != nil {
 		panic(err)
 	}
@@ -29,13 +29,13 @@ func main() {
 			return obj.(*v1.Pod).CreationTimestamp.String()
 		},
 	}
-	indexer, err := sqlcache.NewListOptionIndexer(&v1.Pod{}, "pods.sqlite", fieldFuncs)
+	indexer, err := sqlcache.NewListOptionIndexer(&v1.Pod{}, "pods.sqlite", fieldFuncs, sqlcache.WithReopen())
 	if err != nil {
 		panic(err)
 	}
 
-	// connect the ListWatcher to feed the Indexer
-	r := cache.NewReflector(listWatcher, &v1.Pod{}, indexer, time.Hour)
+	// connect the ListWatcher to feed the Indexer, resuming from data persisted by previous runs if any
+	r := cache.NewReflector(sqlcache.NewResumingListerWatcher(listWatcher, indexer), &v1.Pod{}, indexer, time.Hour)
 
 	// go!
 	var wg wait.Group
@@ -0,0 +1,81 @@
+package sqlcache
+
+import (
+	"database/sql"
+)
+
+// Batch groups upserts and deletions, including all registered functions to be called after them,
+// in a single transaction. Either Commit or Rollback must be called to release it.
+// If any operation returns an error, the Batch should be rolled back
+type Batch struct {
+	store *Store
+	tx    *sql.Tx
+}
+
+// Begin starts a new Batch, after writing operations queued via WithWriteCoalescing, if any
+func (s *Store) Begin() (*Batch, error) {
+	err := s.flush()
+	if err != nil {
+		return nil, err
+	}
+	return s.begin()
+}
+
+// begin starts a new Batch, ignoring queued operations
+func (s *Store) begin() (*Batch, error) {
+	s.trainDictionary()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &Batch{store: s, tx: tx}, nil
+}
+
+// Upsert saves an obj with its key, or updates key with obj if it exists in the Store
+func (b *Batch) Upsert(key string, obj any) error {
+	return b.store.upsert(key, obj, b.tx)
+}
+
+// DeleteByKey deletes the object associated with key, if it exists in the Store
+func (b *Batch) DeleteByKey(key string) error {
+	return b.store.deleteByKey(key, nil, "", b.tx)
+}
+
+// Add saves an obj, or updates it if it exists in the Store
+func (b *Batch) Add(obj any) error {
+	key, err := b.store.keyFunc(obj)
+	if err != nil {
+		return err
+	}
+	return b.Upsert(key, obj)
+}
+
+// Delete deletes the given object, if it exists in the Store. See Store.Delete
+func (b *Batch) Delete(obj any) error {
+	key, err := b.store.keyFunc(obj)
+	if err != nil {
+		return err
+	}
+	return b.store.deleteByKey(key, obj, "", b.tx)
+}
+
+// Commit writes all operations in this Batch
+func (b *Batch) Commit() error {
+	err := b.tx.Commit()
+	if err != nil {
+		return err
+	}
+	b.store.runAfterCommit()
+	return nil
+}
+
+// Rollback discards all operations in this Batch
+func (b *Batch) Rollback() error {
+	return b.tx.Rollback()
+}
+
+// rollback discards all operations in this Batch after err, wrapping errors if needed
+func (b *Batch) rollback(err error) error {
+	return b.store.rollback(err, b.tx)
+}
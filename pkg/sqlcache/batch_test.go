@@ -0,0 +1,263 @@
+package sqlcache
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBatch(t *testing.T) {
+	assert := assert.New(t)
+
+	store, err := NewIndexer(testStoreObject{}, testStoreKeyFunc, TEST_DB_LOCATION, testStoreIndexers())
+	assert.NoError(err)
+
+	// committed operations are visible, including their indices
+	b, err := store.Begin()
+	assert.NoError(err)
+	assert.NoError(b.Add(testStoreObject{Id: "a", Val: "b"}))
+	assert.NoError(b.Add(testStoreObject{Id: "c", Val: "d"}))
+	assert.NoError(b.Upsert("e", testStoreObject{Id: "e", Val: "b"}))
+	assert.NoError(b.Delete(testStoreObject{Id: "c"}))
+	assert.NoError(b.Commit())
+	assert.ElementsMatch([]string{"a", "e"}, store.ListKeys())
+	keys, err := store.IndexKeys("by_val", "b")
+	assert.NoError(err)
+	assert.ElementsMatch([]string{"a", "e"}, keys)
+
+	// rolled back operations are not
+	b, err = store.Begin()
+	assert.NoError(err)
+	assert.NoError(b.DeleteByKey("a"))
+	assert.NoError(b.Rollback())
+	assert.ElementsMatch([]string{"a", "e"}, store.ListKeys())
+
+	assert.NoError(store.Close())
+}
+
+func TestWriteCoalescing(t *testing.T) {
+	assert := assert.New(t)
+
+	store, err := NewStore(testStoreObject{}, testStoreKeyFunc, TEST_DB_LOCATION, WithWriteCoalescing(50*time.Millisecond, 3))
+	assert.NoError(err)
+	count := func() int {
+		var result int
+		assert.NoError(store.db.QueryRow(`SELECT COUNT(*) FROM objects`).Scan(&result))
+		return result
+	}
+
+	// writes are queued...
+	assert.NoError(store.Add(testStoreObject{Id: "a", Val: "a"}))
+	assert.NoError(store.Add(testStoreObject{Id: "b", Val: "b"}))
+	assert.Equal(0, count())
+	// ...until maxWrites is reached
+	assert.NoError(store.Delete(testStoreObject{Id: "a"}))
+	assert.Equal(1, count())
+
+	// ...or interval passes
+	assert.NoError(store.Add(testStoreObject{Id: "c", Val: "c"}))
+	assert.Equal(1, count())
+	assert.Eventually(func() bool { return count() == 2 }, time.Second, 10*time.Millisecond)
+
+	// ...or a read happens
+	assert.NoError(store.Add(testStoreObject{Id: "d", Val: "d"}))
+	item, exists, err := store.GetByKey("d")
+	assert.NoError(err)
+	assert.True(exists)
+	assert.Equal("d", item.(testStoreObject).Val)
+
+	// ...or the Store is closed
+	assert.NoError(store.Add(testStoreObject{Id: "e", Val: "e"}))
+	assert.NoError(store.Close())
+	store, err = NewStore(testStoreObject{}, testStoreKeyFunc, TEST_DB_LOCATION, WithReopen())
+	assert.NoError(err)
+	assert.ElementsMatch([]string{"b", "c", "d", "e"}, store.ListKeys())
+	assert.NoError(store.Close())
+}
+
+func TestWriteCoalescingErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	// the ErrorHandler blocks until gate is closed
+	gate := make(chan struct{})
+	handled := make(chan error, 10)
+	l, err := NewListOptionIndexer(&v1.Pod{}, TEST_DB_LOCATION, fieldFunc, WithWriteCoalescing(0, 3),
+		WithErrorHandler(func(err error) {
+			<-gate
+			handled <- err
+		}))
+	assert.NoError(err)
+	pod := func(name string, resourceVersion string) *v1.Pod {
+		return &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name, ResourceVersion: resourceVersion}}
+	}
+
+	// a failing write does not discard the others, and its error is neither returned nor handled by other writes or
+	// reads...
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		assert.NoError(l.Add(pod("a", "1")))
+		assert.NoError(l.Add(pod("b", "notanumber")))
+		assert.NoError(l.Add(pod("c", "3")))
+		assert.NoError(l.Add(pod("d", "notanumber")))
+		keys, err := l.SafeListKeys()
+		assert.NoError(err)
+		assert.ElementsMatch([]string{"a", "c"}, keys)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		assert.Fail("writes or reads waited for the ErrorHandler")
+	}
+
+	// ...it is handled in the background instead
+	close(gate)
+	failed := sets.String{}
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-handled:
+			assert.ErrorContains(err, "non-integer version")
+			for _, key := range []string{"b", "d"} {
+				if strings.Contains(err.Error(), "write of "+key) {
+					failed.Insert(key)
+				}
+			}
+		case <-time.After(5 * time.Second):
+			assert.Fail("errors were not handled")
+		}
+	}
+	assert.Equal(sets.NewString("b", "d"), failed)
+
+	// the write that triggered the flush gets its own error
+	assert.NoError(l.Add(pod("e", "5")))
+	assert.NoError(l.Add(pod("f", "6")))
+	assert.ErrorContains(l.Add(pod("g", "notanumber")), "non-integer version")
+	keys, err := l.SafeListKeys()
+	assert.NoError(err)
+	assert.ElementsMatch([]string{"a", "c", "e", "f"}, keys)
+	assert.Empty(handled)
+
+	assert.NoError(l.Close())
+}
+
+func TestWriteCoalescingRequeue(t *testing.T) {
+	assert := assert.New(t)
+
+	store, err := NewStore(testStoreObject{}, testStoreKeyFunc, TEST_DB_LOCATION, WithWriteCoalescing(time.Hour, 0))
+	assert.NoError(err)
+
+	// if no transaction can be started, writes no caller waits for are queued again, in order
+	assert.NoError(store.Upsert("c", testStoreObject{Id: "c", Val: "c"}))
+	a := &pendingWrite{key: "a", obj: testStoreObject{Id: "a", Val: "a"}}
+	b := &pendingWrite{key: "b", waiting: true}
+	store.coalescer.requeue([]*pendingWrite{a, b}, errors.New("busy"))
+	keys := []string{}
+	for _, w := range store.coalescer.pending {
+		keys = append(keys, w.key)
+	}
+	assert.Equal([]string{"a", "c"}, keys)
+	assert.NoError(a.err)
+	assert.EqualError(b.err, "busy")
+
+	// they are applied by the next flush
+	found, err := store.SafeListKeys()
+	assert.NoError(err)
+	assert.ElementsMatch([]string{"a", "c"}, found)
+
+	assert.NoError(store.Close())
+}
+
+func TestWriteCoalescingBeforeBatch(t *testing.T) {
+	assert := assert.New(t)
+
+	store, err := NewStore(testStoreObject{}, testStoreKeyFunc, TEST_DB_LOCATION, WithWriteCoalescing(time.Hour, 0))
+	assert.NoError(err)
+
+	// queued writes are applied before a Batch, so they cannot overwrite it
+	assert.NoError(store.Upsert("a", testStoreObject{Id: "a", Val: "old"}))
+	b, err := store.Begin()
+	assert.NoError(err)
+	assert.NoError(b.Upsert("a", testStoreObject{Id: "a", Val: "new"}))
+	assert.NoError(b.Commit())
+	item, exists, err := store.GetByKey("a")
+	assert.NoError(err)
+	assert.True(exists)
+	assert.Equal("new", item.(testStoreObject).Val)
+
+	assert.NoError(store.Close())
+}
+
+func BenchmarkUpsert(b *testing.B) {
+	store, err := NewIndexer(testStoreObject{}, testStoreKeyFunc, TEST_DB_LOCATION, testStoreIndexers())
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err = store.Add(testStoreObject{Id: fmt.Sprint(i), Val: fmt.Sprint(i % 10)})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	err = store.Close()
+	if err != nil {
+		b.Fatal(err)
+	}
+}
+
+func BenchmarkBatchUpsert(b *testing.B) {
+	store, err := NewIndexer(testStoreObject{}, testStoreKeyFunc, TEST_DB_LOCATION, testStoreIndexers())
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	batch, err := store.Begin()
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < b.N; i++ {
+		err = batch.Add(testStoreObject{Id: fmt.Sprint(i), Val: fmt.Sprint(i % 10)})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	err = batch.Commit()
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.StopTimer()
+	err = store.Close()
+	if err != nil {
+		b.Fatal(err)
+	}
+}
+
+func BenchmarkCoalescedUpsert(b *testing.B) {
+	store, err := NewIndexer(testStoreObject{}, testStoreKeyFunc, TEST_DB_LOCATION, testStoreIndexers(), WithWriteCoalescing(100*time.Millisecond, 1000))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err = store.Add(testStoreObject{Id: fmt.Sprint(i), Val: fmt.Sprint(i % 10)})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	err = store.flush()
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.StopTimer()
+	err = store.Close()
+	if err != nil {
+		b.Fatal(err)
+	}
+}
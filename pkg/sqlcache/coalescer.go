@@ -0,0 +1,201 @@
+package sqlcache
+
+import (
+	"github.com/pkg/errors"
+	"sync"
+	"time"
+)
+
+// pendingWrite is an upsert or deletion queued by a coalescer. For deletions, obj is the final state, if known
+type pendingWrite struct {
+	key    string
+	obj    any
+	delete bool
+
+	// waiting is true if the caller queueing this write waits for it to be applied, and handles err
+	waiting bool
+	// err is the error applying this write, if any
+	err error
+}
+
+// coalescer queues writes to a Store and applies them in batches, see WithWriteCoalescing
+type coalescer struct {
+	store     *Store
+	interval  time.Duration
+	maxWrites int
+
+	// lock protects pending, failed and timer
+	lock    sync.Mutex
+	pending []*pendingWrite
+	// failed holds writes no caller waits for that failed, until the timer reports them
+	failed  []*pendingWrite
+	timer   *time.Timer
+	stopped bool
+
+	// flushLock serializes flushes, so that writes are applied in order
+	flushLock sync.Mutex
+}
+
+// newCoalescer returns a coalescer for store
+func newCoalescer(store *Store, interval time.Duration, maxWrites int) *coalescer {
+	return &coalescer{
+		store:     store,
+		interval:  interval,
+		maxWrites: maxWrites,
+	}
+}
+
+// enqueue queues a write. If maxWrites is reached, all queued writes are applied and any error applying w is returned
+func (c *coalescer) enqueue(w *pendingWrite) error {
+	c.lock.Lock()
+	c.pending = append(c.pending, w)
+	full := c.maxWrites > 0 && len(c.pending) >= c.maxWrites
+	w.waiting = full
+	if !full && c.timer == nil && c.interval > 0 && !c.stopped {
+		c.timer = time.AfterFunc(c.interval, c.flushOnTimer)
+	}
+	c.lock.Unlock()
+
+	if full {
+		err := c.flush()
+		if err != nil {
+			return err
+		}
+		// w was applied by this or a concurrent flush, which completed before this one started
+		return w.err
+	}
+	return nil
+}
+
+// flushOnTimer applies queued writes, handling errors via the ErrorHandler
+func (c *coalescer) flushOnTimer() {
+	failed, err := c.applyPending()
+	c.lock.Lock()
+	failed = append(c.failed, failed...)
+	c.failed = nil
+	c.lock.Unlock()
+
+	if err != nil {
+		c.store.handleError(errors.Wrap(err, "Unexpected error writing coalesced writes"))
+	}
+	for _, w := range failed {
+		if !w.waiting {
+			c.store.handleError(errors.Wrapf(w.err, "Unexpected error writing coalesced write of %s", w.key))
+		}
+	}
+}
+
+// flush applies all queued writes in a single transaction. Errors applying writes do not affect other writes. They
+// are returned to callers waiting for them (see enqueue), and otherwise reported by the timer via the ErrorHandler, so
+// that they never reach unrelated callers
+func (c *coalescer) flush() error {
+	failed, err := c.applyPending()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, w := range failed {
+		if !w.waiting {
+			c.failed = append(c.failed, w)
+		}
+	}
+	if len(c.failed) > 0 && c.timer == nil {
+		c.timer = time.AfterFunc(0, c.flushOnTimer)
+	}
+	return err
+}
+
+// applyPending applies all queued writes, returning those that failed. If no transaction can be started, writes no
+// caller waits for are queued again
+func (c *coalescer) applyPending() ([]*pendingWrite, error) {
+	c.flushLock.Lock()
+	defer c.flushLock.Unlock()
+
+	c.lock.Lock()
+	pending := c.pending
+	c.pending = nil
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	c.lock.Unlock()
+
+	if len(pending) == 0 {
+		return nil, nil
+	}
+
+	b, err := c.store.begin()
+	if err != nil {
+		c.requeue(pending, err)
+		return nil, err
+	}
+	failed := []*pendingWrite{}
+	for _, w := range pending {
+		w.err = c.apply(b, w)
+		if w.err != nil {
+			failed = append(failed, w)
+		}
+	}
+	return failed, b.Commit()
+}
+
+// requeue queues writes no caller waits for again, ahead of writes queued since. Waiting writes fail with err
+func (c *coalescer) requeue(writes []*pendingWrite, err error) {
+	requeued := []*pendingWrite{}
+	for _, w := range writes {
+		if w.waiting {
+			w.err = err
+		} else {
+			requeued = append(requeued, w)
+		}
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.pending = append(requeued, c.pending...)
+	if len(c.pending) > 0 && c.timer == nil && c.interval > 0 && !c.stopped {
+		c.timer = time.AfterFunc(c.interval, c.flushOnTimer)
+	}
+}
+
+// apply applies w as part of b, within a savepoint so that failures only discard w
+func (c *coalescer) apply(b *Batch, w *pendingWrite) error {
+	_, err := b.tx.Exec(`SAVEPOINT pending_write`)
+	if err != nil {
+		return err
+	}
+	if w.delete {
+		err = b.store.deleteByKey(w.key, w.obj, "", b.tx)
+	} else {
+		err = b.Upsert(w.key, w.obj)
+	}
+	if err != nil {
+		_, rerr := b.tx.Exec(`ROLLBACK TO pending_write`)
+		if rerr != nil {
+			return errors.Wrap(rerr, "while handling "+err.Error())
+		}
+	}
+	_, rerr := b.tx.Exec(`RELEASE pending_write`)
+	if err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// stop prevents further timer-triggered flushes
+func (c *coalescer) stop() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.stopped = true
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+}
+
+// flush applies all writes queued via WithWriteCoalescing, if any
+func (s *Store) flush() error {
+	if s.coalescer == nil {
+		return nil
+	}
+	return s.coalescer.flush()
+}
@@ -0,0 +1,110 @@
+package sqlcache
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/serializer/protobuf"
+	"reflect"
+)
+
+// Codec encodes objects to, and decodes objects from, the bytes stored in the database
+type Codec interface {
+	// Encode returns the byte representation of obj
+	Encode(obj any) ([]byte, error)
+	// Decode returns a new object of type typ from its byte representation
+	Decode(data []byte, typ reflect.Type) (any, error)
+}
+
+// GobCodec is a Codec based on encoding/gob. It is the default and can handle any Go value
+type GobCodec struct{}
+
+// Encode encodes obj with encoding/gob
+func (GobCodec) Encode(obj any) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	err := enc.Encode(obj)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while gobbing object")
+	}
+	return buf.Bytes(), nil
+}
+
+// Decode decodes an object of type typ with encoding/gob
+func (GobCodec) Decode(data []byte, typ reflect.Type) (any, error) {
+	dec := gob.NewDecoder(bytes.NewReader(data))
+	result := reflect.New(typ)
+	err := dec.DecodeValue(result)
+	if err != nil {
+		return nil, err
+	}
+	return result.Elem().Interface(), nil
+}
+
+// JSONCodec is a Codec based on encoding/json. Stored objects are readable by non-Go tools, eg. via SQLite's JSON functions
+type JSONCodec struct{}
+
+// Encode encodes obj with encoding/json
+func (JSONCodec) Encode(obj any) ([]byte, error) {
+	result, err := json.Marshal(obj)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while encoding object to JSON")
+	}
+	return result, nil
+}
+
+// Decode decodes an object of type typ with encoding/json
+func (JSONCodec) Decode(data []byte, typ reflect.Type) (any, error) {
+	result := reflect.New(typ)
+	err := json.Unmarshal(data, result.Interface())
+	if err != nil {
+		return nil, err
+	}
+	return result.Elem().Interface(), nil
+}
+
+// ProtobufCodec is a Codec based on the Kubernetes protobuf serializer. It only handles pointers to runtime.Objects
+// supporting protobuf, such as all core Kubernetes types
+type ProtobufCodec struct {
+	serializer *protobuf.Serializer
+}
+
+// NewProtobufCodec returns a ProtobufCodec for objects of types registered in scheme (eg. client-go's scheme.Scheme)
+func NewProtobufCodec(scheme *runtime.Scheme) *ProtobufCodec {
+	return &ProtobufCodec{
+		serializer: protobuf.NewSerializer(scheme, scheme),
+	}
+}
+
+// Encode encodes obj, which must be a runtime.Object, with the Kubernetes protobuf serializer
+func (p *ProtobufCodec) Encode(obj any) ([]byte, error) {
+	o, ok := obj.(runtime.Object)
+	if !ok {
+		return nil, errors.Errorf("Unexpected object does not conform to runtime.Object: %v", obj)
+	}
+	var buf bytes.Buffer
+	err := p.serializer.Encode(o, &buf)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while encoding object to protobuf")
+	}
+	return buf.Bytes(), nil
+}
+
+// Decode decodes an object of type typ, which must be a pointer to a runtime.Object, with the Kubernetes protobuf serializer.
+// Note that decoded objects always have their TypeMeta (apiVersion and kind) set
+func (p *ProtobufCodec) Decode(data []byte, typ reflect.Type) (any, error) {
+	if typ.Kind() != reflect.Pointer {
+		return nil, errors.Errorf("Unexpected non-pointer type: %v", typ)
+	}
+	into, ok := reflect.New(typ.Elem()).Interface().(runtime.Object)
+	if !ok {
+		return nil, errors.Errorf("Unexpected type does not conform to runtime.Object: %v", typ)
+	}
+	result, _, err := p.serializer.Decode(data, nil, into)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
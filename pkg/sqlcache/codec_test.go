@@ -0,0 +1,71 @@
+package sqlcache
+
+import (
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"reflect"
+	"testing"
+)
+
+// testCodecs returns all Codecs able to handle any Go value
+func testCodecs() map[string]Codec {
+	return map[string]Codec{
+		"gob":  GobCodec{},
+		"json": JSONCodec{},
+	}
+}
+
+// testKubernetesCodecs returns all Codecs able to handle Kubernetes objects
+func testKubernetesCodecs() map[string]Codec {
+	result := testCodecs()
+	result["protobuf"] = NewProtobufCodec(scheme.Scheme)
+	return result
+}
+
+func TestCodecs(t *testing.T) {
+	pod := &v1.Pod{
+		TypeMeta: metav1.TypeMeta{Kind: "Pod", APIVersion: "v1"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "focus",
+			ResourceVersion: "1",
+			Labels: map[string]string{
+				"Brand": "ford",
+			},
+		},
+		Spec: v1.PodSpec{NodeName: "node1"},
+	}
+
+	for name, codec := range testKubernetesCodecs() {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			data, err := codec.Encode(pod)
+			assert.NoError(err)
+			decoded, err := codec.Decode(data, reflect.TypeOf(pod))
+			assert.NoError(err)
+			assert.Equal(pod, decoded)
+		})
+	}
+
+	// protobuf only supports runtime.Objects
+	_, err := NewProtobufCodec(scheme.Scheme).Encode(testStoreObject{Id: "a", Val: "b"})
+	assert.Error(t, err)
+}
+
+func TestJSONCodecReadableBySQLite(t *testing.T) {
+	assert := assert.New(t)
+
+	// small objects are not worth compressing, so they stay readable
+	store, err := NewStore(testStoreObject{}, testStoreKeyFunc, TEST_DB_LOCATION, WithCodec(JSONCodec{}), WithCompression(GzipCompression))
+	assert.NoError(err)
+	assert.NoError(store.Add(testStoreObject{Id: "a", Val: "b"}))
+
+	var val string
+	err = store.db.QueryRow(`SELECT json_extract(object, '$.Val') FROM objects WHERE key = ?`, "a").Scan(&val)
+	assert.NoError(err)
+	assert.Equal("b", val)
+
+	assert.NoError(store.Close())
+}
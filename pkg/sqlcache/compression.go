@@ -0,0 +1,213 @@
+package sqlcache
+
+import (
+	"bytes"
+	"encoding/base64"
+	"github.com/klauspost/compress/dict"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// Compression is an algorithm used to compress encoded objects before storing them
+type Compression int
+
+const (
+	// NoCompression stores encoded objects as they are
+	NoCompression Compression = iota
+	// GzipCompression compresses encoded objects with gzip
+	GzipCompression
+	// ZstdCompression compresses encoded objects with Zstandard, optionally with a trained dictionary
+	ZstdCompression
+)
+
+// zstdDictionaryMetadata is the name of the metadata entry holding the trained zstd dictionary, if any
+const zstdDictionaryMetadata = "zstd_dictionary"
+
+// Magic bytes compressed rows start with. Rows not starting with either are stored as encoded by the Codec
+var (
+	gzipMagic = []byte{0x1f, 0x8b, 0x08}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// CompressionStats reports the effect of compression on objects stored since the Store was created
+type CompressionStats struct {
+	// UncompressedBytes is the total size of encoded objects before compression
+	UncompressedBytes int64
+	// StoredBytes is the total size of encoded objects as stored, after compression
+	StoredBytes int64
+}
+
+// Ratio returns the compression ratio (uncompressed size over stored size), or 1 if nothing was stored yet
+func (c CompressionStats) Ratio() float64 {
+	if c.StoredBytes == 0 {
+		return 1
+	}
+	return float64(c.UncompressedBytes) / float64(c.StoredBytes)
+}
+
+// compressor compresses and decompresses encoded objects
+type compressor struct {
+	compression       Compression
+	dictionarySamples int
+
+	lock       sync.RWMutex
+	samples    [][]byte
+	dictionary []byte
+	encoder    *zstd.Encoder
+	decoder    *zstd.Decoder
+
+	uncompressedBytes atomic.Int64
+	storedBytes       atomic.Int64
+}
+
+// newCompressor returns a compressor for compression. If dictionarySamples is positive and compression is
+// ZstdCompression, a dictionary is trained from the first dictionarySamples objects.
+// A previously trained dictionary, if any, is used to decompress rows regardless of the other settings
+func newCompressor(compression Compression, dictionarySamples int, dictionary []byte) (*compressor, error) {
+	c := &compressor{
+		compression:       compression,
+		dictionarySamples: dictionarySamples,
+	}
+	err := c.setDictionary(dictionary)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// setDictionary (re)creates zstd encoder and decoder using dictionary, which may be nil
+func (c *compressor) setDictionary(dictionary []byte) error {
+	encoderOptions := []zstd.EOption{}
+	decoderOptions := []zstd.DOption{}
+	if dictionary != nil {
+		encoderOptions = append(encoderOptions, zstd.WithEncoderDict(dictionary))
+		decoderOptions = append(decoderOptions, zstd.WithDecoderDicts(dictionary))
+	}
+	encoder, err := zstd.NewWriter(nil, encoderOptions...)
+	if err != nil {
+		return errors.Wrap(err, "Error creating zstd encoder")
+	}
+	decoder, err := zstd.NewReader(nil, decoderOptions...)
+	if err != nil {
+		return errors.Wrap(err, "Error creating zstd decoder")
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.dictionary = dictionary
+	c.encoder = encoder
+	c.decoder = decoder
+	return nil
+}
+
+// compress returns the compressed version of data, or data itself if compression does not make it smaller.
+// Uncompressed rows are thus byte-identical to the Codec output, eg. readable by SQLite's JSON functions, except for
+// the unlikely case of data starting with magic bytes, which is always compressed so that it is not mistaken for
+// compressed data
+func (c *compressor) compress(data []byte) ([]byte, error) {
+	compression := c.compression
+	if compression == NoCompression && hasCompressionMagic(data) {
+		compression = GzipCompression
+	}
+
+	result := data
+	switch compression {
+	case GzipCompression:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		_, err := w.Write(data)
+		if err != nil {
+			return nil, err
+		}
+		err = w.Close()
+		if err != nil {
+			return nil, err
+		}
+		result = buf.Bytes()
+	case ZstdCompression:
+		c.lock.Lock()
+		if c.dictionary == nil && len(c.samples) < c.dictionarySamples {
+			c.samples = append(c.samples, append([]byte{}, data...))
+		}
+		encoder := c.encoder
+		c.lock.Unlock()
+		result = encoder.EncodeAll(data, nil)
+	}
+
+	if len(result) >= len(data) && !hasCompressionMagic(data) {
+		result = data
+	}
+	c.uncompressedBytes.Add(int64(len(data)))
+	c.storedBytes.Add(int64(len(result)))
+	return result, nil
+}
+
+// decompress returns the decompressed version of data, as returned by compress
+func (c *compressor) decompress(data []byte) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(data, gzipMagic):
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		return io.ReadAll(r)
+	case bytes.HasPrefix(data, zstdMagic):
+		c.lock.RLock()
+		decoder := c.decoder
+		c.lock.RUnlock()
+		return decoder.DecodeAll(data, nil)
+	}
+	return data, nil
+}
+
+// hasCompressionMagic returns true if data starts like a compressed row
+func hasCompressionMagic(data []byte) bool {
+	return bytes.HasPrefix(data, gzipMagic) || bytes.HasPrefix(data, zstdMagic)
+}
+
+// trainDictionary returns a new zstd dictionary if enough samples were collected, nil otherwise
+func (c *compressor) trainDictionary() ([]byte, error) {
+	c.lock.Lock()
+	if c.dictionary != nil || c.dictionarySamples <= 0 || len(c.samples) < c.dictionarySamples {
+		c.lock.Unlock()
+		return nil, nil
+	}
+	samples := c.samples
+	c.samples = nil
+	c.dictionarySamples = 0 // train at most once
+	c.lock.Unlock()
+
+	dictionary, err := dict.BuildZstdDict(samples, dict.Options{
+		MaxDictSize: 64 * 1024,
+		HashBytes:   6,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "Error training zstd dictionary")
+	}
+	return dictionary, nil
+}
+
+// stats returns CompressionStats
+func (c *compressor) stats() CompressionStats {
+	return CompressionStats{
+		UncompressedBytes: c.uncompressedBytes.Load(),
+		StoredBytes:       c.storedBytes.Load(),
+	}
+}
+
+// encodeDictionary returns a representation of dictionary suitable for the metadata table
+func encodeDictionary(dictionary []byte) string {
+	return base64.StdEncoding.EncodeToString(dictionary)
+}
+
+// decodeDictionary parses the representation of a dictionary in the metadata table
+func decodeDictionary(value string) ([]byte, error) {
+	if value == "" {
+		return nil, nil
+	}
+	return base64.StdEncoding.DecodeString(value)
+}
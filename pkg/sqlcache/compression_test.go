@@ -0,0 +1,95 @@
+package sqlcache
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"strings"
+	"testing"
+)
+
+func testCompressiblePod(i int) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            fmt.Sprintf("pod%d", i),
+			ResourceVersion: fmt.Sprint(i + 1),
+			Annotations: map[string]string{
+				"description": strings.Repeat(fmt.Sprintf("a rather repetitive description of pod %d. ", i), 20),
+			},
+		},
+	}
+}
+
+func TestCompression(t *testing.T) {
+	cases := map[string][]Option{
+		"gzip":            {WithCompression(GzipCompression)},
+		"zstd":            {WithCompression(ZstdCompression)},
+		"zstd-dictionary": {WithCompression(ZstdCompression), WithZstdDictionary(10)},
+	}
+
+	for name, opts := range cases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			// start with some uncompressed rows
+			l, err := NewListOptionIndexer(&v1.Pod{}, TEST_DB_LOCATION, fieldFunc)
+			assert.NoError(err)
+			assert.NoError(l.Add(testCompressiblePod(0)))
+			assert.NoError(l.Close())
+
+			// then add compressed ones
+			l, err = NewListOptionIndexer(&v1.Pod{}, TEST_DB_LOCATION, fieldFunc, append(opts, WithReopen())...)
+			assert.NoError(err)
+			for i := 1; i < 50; i++ {
+				assert.NoError(l.Add(testCompressiblePod(i)))
+			}
+			assert.Greater(l.CompressionStats().Ratio(), 2.0)
+			dictionary, err := l.GetMetadata(zstdDictionaryMetadata)
+			assert.NoError(err)
+			assert.Equal(name == "zstd-dictionary", dictionary != "")
+			assert.NoError(l.Close())
+
+			// all rows are readable, even without compression settings
+			l, err = NewListOptionIndexer(&v1.Pod{}, TEST_DB_LOCATION, fieldFunc, WithReopen())
+			assert.NoError(err)
+			for i := 0; i < 50; i++ {
+				item, found, err := l.GetByKey(fmt.Sprintf("pod%d", i))
+				assert.NoError(err)
+				assert.True(found)
+				assert.Equal(testCompressiblePod(i).Annotations, item.(*v1.Pod).Annotations)
+			}
+			assert.Equal(1.0, l.CompressionStats().Ratio())
+			assert.NoError(l.Close())
+		})
+	}
+}
+
+func TestCompressionMagic(t *testing.T) {
+	assert := assert.New(t)
+
+	// encoded objects looking like compressed data are not mistaken for it
+	samples := [][]byte{
+		{0x1f, 0x8b, 0x08, 0x00},
+		{0x28, 0xb5, 0x2f, 0xfd, 0x00},
+		[]byte(strings.Repeat("\x1f\x8b compressible", 100)),
+		{},
+	}
+	for _, compression := range []Compression{NoCompression, GzipCompression, ZstdCompression} {
+		c, err := newCompressor(compression, 0, nil)
+		assert.NoError(err)
+		for _, sample := range samples {
+			compressed, err := c.compress(sample)
+			assert.NoError(err)
+			decompressed, err := c.decompress(compressed)
+			assert.NoError(err)
+			assert.Equal(sample, decompressed)
+		}
+
+		// uncompressed rows are stored as they are
+		data := []byte(`{"a":"b"}`)
+		compressed, err := c.compress(data)
+		assert.NoError(err)
+		assert.Equal(data, compressed)
+	}
+}
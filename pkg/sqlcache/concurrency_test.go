@@ -0,0 +1,158 @@
+package sqlcache
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestConcurrentAccess is a stress test meant to be run with -race
+func TestConcurrentAccess(t *testing.T) {
+	assert := assert.New(t)
+
+	s, err := NewThreadSafeStore(testStoreObject{}, TEST_DB_LOCATION, testStoreIndexers())
+	assert.NoError(err)
+	store := s.(SafeThreadSafeStore)
+
+	const writers = 4
+	const readers = 8
+	const iterations = 100
+
+	// the last operation on keys 0 to 9 of each writer is, respectively: delete, add, delete, add...
+	expected := map[string]any{}
+	for w := 0; w < writers; w++ {
+		for i := 0; i < 10; i++ {
+			key := fmt.Sprintf("w%d-%d", w, i)
+			if (iterations-10+i)%3 != 2 {
+				expected[key] = testStoreObject{Id: key, Val: fmt.Sprintf("w%d", w)}
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	// Replace races with writers, but brings every key to the same state their last write does
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10; i++ {
+			assert.NoError(store.SafeReplace(expected, ""))
+		}
+	}()
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			val := fmt.Sprintf("w%d", w)
+			for i := 0; i < iterations; i++ {
+				key := fmt.Sprintf("%s-%d", val, i%10)
+				var err error
+				switch i % 3 {
+				case 0, 1:
+					err = store.SafeAdd(key, testStoreObject{Id: key, Val: val})
+				case 2:
+					err = store.SafeDelete(key)
+				}
+				assert.NoError(err)
+			}
+		}(w)
+	}
+
+	// readers only ever see consistent objects and indices
+	for r := 0; r < readers; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			val := fmt.Sprintf("w%d", r%writers)
+			for i := 0; i < iterations; i++ {
+				items, err := store.SafeList()
+				assert.NoError(err)
+				for _, item := range items {
+					o := item.(testStoreObject)
+					assert.True(strings.HasPrefix(o.Id, o.Val+"-"), "inconsistent object %v", o)
+				}
+
+				items, err = store.ByIndex("by_val", val)
+				assert.NoError(err)
+				for _, item := range items {
+					assert.Equal(val, item.(testStoreObject).Val)
+				}
+
+				key := fmt.Sprintf("%s-%d", val, i%10)
+				item, exists, err := store.SafeGet(key)
+				assert.NoError(err)
+				if exists {
+					assert.Equal(key, item.(testStoreObject).Id)
+				}
+
+				_, err = store.SafeListKeys()
+				assert.NoError(err)
+			}
+		}(r)
+	}
+	wg.Wait()
+
+	// all writes are eventually visible, regardless of how they interleaved with Replace
+	for w := 0; w < writers; w++ {
+		for i := 0; i < 10; i++ {
+			key := fmt.Sprintf("w%d-%d", w, i)
+			item, exists, err := store.SafeGet(key)
+			assert.NoError(err)
+			assert.Equal(expected[key] != nil, exists, key)
+			if exists {
+				assert.Equal(expected[key], item, key)
+			}
+		}
+	}
+	keys, err := store.SafeListKeys()
+	assert.NoError(err)
+	assert.Len(keys, len(expected))
+	for w := 0; w < writers; w++ {
+		keys, err := store.IndexKeys("by_val", fmt.Sprintf("w%d", w))
+		assert.NoError(err)
+		assert.Len(keys, len(expected)/writers)
+	}
+	assert.NoError(s.(*threadSafeStore).Close())
+}
+
+func TestReadsDoNotWaitForWrites(t *testing.T) {
+	assert := assert.New(t)
+
+	store, err := NewIndexer(testStoreObject{}, testStoreKeyFunc, TEST_DB_LOCATION, testStoreIndexers())
+	assert.NoError(err)
+	assert.NoError(store.Add(testStoreObject{Id: "a", Val: "old"}))
+
+	// hold the writer connection with an uncommitted change
+	b, err := store.Begin()
+	assert.NoError(err)
+	assert.NoError(b.Add(testStoreObject{Id: "a", Val: "new"}))
+
+	done := make(chan any)
+	go func() {
+		defer close(done)
+		item, exists, err := store.GetByKey("a")
+		assert.NoError(err)
+		assert.True(exists)
+		assert.Equal("old", item.(testStoreObject).Val)
+
+		keys, err := store.IndexKeys("by_val", "old")
+		assert.NoError(err)
+		assert.Equal([]string{"a"}, keys)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("read blocked by a write transaction")
+	}
+
+	// committed writes are visible to subsequent reads
+	assert.NoError(b.Commit())
+	item, exists, err := store.GetByKey("a")
+	assert.NoError(err)
+	assert.True(exists)
+	assert.Equal("new", item.(testStoreObject).Val)
+
+	assert.NoError(store.Close())
+}
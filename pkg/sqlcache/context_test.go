@@ -0,0 +1,47 @@
+package sqlcache
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"testing"
+	"time"
+)
+
+func TestContextCancellation(t *testing.T) {
+	assert := assert.New(t)
+
+	l, err := NewListOptionIndexer(&v1.Pod{}, TEST_DB_LOCATION, fieldFunc)
+	assert.NoError(err)
+	assert.NoError(l.Add(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "a", ResourceVersion: "1"}}))
+
+	// a live context works as usual
+	ctx := context.Background()
+	r, err := l.ListByOptionsContext(ctx, ListOptions{})
+	assert.NoError(err)
+	assert.Len(r, 1)
+	_, found, err := l.GetByKeyContext(ctx, "a")
+	assert.NoError(err)
+	assert.True(found)
+
+	// a cancelled context stops queries
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = l.ListByOptionsContext(ctx, ListOptions{})
+	assert.ErrorIs(err, context.Canceled)
+	_, _, err = l.GetByKeyContext(ctx, "a")
+	assert.ErrorIs(err, context.Canceled)
+	_, err = l.ByIndexContext(ctx, "none", "none")
+	assert.ErrorIs(err, context.Canceled)
+	_, err = l.QueryStringsContext(ctx, l.listKeysStmt)
+	assert.ErrorIs(err, context.Canceled)
+
+	// so does an expired deadline
+	ctx, cancel = context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	_, err = l.QueryObjectsContext(ctx, l.listStmt)
+	assert.ErrorIs(err, context.DeadlineExceeded)
+
+	assert.NoError(l.Close())
+}
@@ -0,0 +1,155 @@
+package sqlcache
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"strings"
+)
+
+// continueToken is the position of the last object returned in a chunk, see ListOptions.Resume
+type continueToken struct {
+	// Revision is the revision the listing started at, so that all chunks are consistent
+	Revision int `json:"revision"`
+	// Key is the key of the last object
+	Key string `json:"key"`
+	// Values are the sort field values of the last object
+	Values []any `json:"values,omitempty"`
+}
+
+// encode returns t as an opaque string
+func (t continueToken) encode() (string, error) {
+	buf, err := json.Marshal(t)
+	if err != nil {
+		return "", errors.Wrap(err, "Error while encoding continue token")
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// decodeContinueToken parses a token produced by encode
+func decodeContinueToken(s string) (continueToken, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return continueToken{}, errors.Wrapf(err, "Invalid continue token %q", s)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(buf))
+	// numbers are kept exact, then converted to the types SQLite returns
+	decoder.UseNumber()
+	var result continueToken
+	err = decoder.Decode(&result)
+	if err != nil {
+		return continueToken{}, errors.Wrapf(err, "Invalid continue token %q", s)
+	}
+	for i, value := range result.Values {
+		number, ok := value.(json.Number)
+		if !ok {
+			continue
+		}
+		if integer, err := number.Int64(); err == nil {
+			result.Values[i] = integer
+		} else if float, err := number.Float64(); err == nil {
+			result.Values[i] = float
+		} else {
+			return continueToken{}, errors.Wrapf(err, "Invalid continue token %q", s)
+		}
+	}
+	return result, nil
+}
+
+// keysetColumn is an expression results are sorted by, along with its parameters
+type keysetColumn struct {
+	expression string
+	params     []any
+	desc       bool
+}
+
+// keysetClause returns a WHERE clause matching rows sorted after values in columns, with its parameters.
+// NULLs sort first in ascending order, as in SQLite
+func keysetClause(columns []keysetColumn, values []any) (string, []any) {
+	column := columns[0]
+	value := values[0]
+	var after, equal string
+	var afterParams, equalParams []any
+	switch {
+	case value == nil && !column.desc:
+		after, afterParams = column.expression+" IS NOT NULL", column.params
+		equal, equalParams = column.expression+" IS NULL", column.params
+	case value == nil && column.desc:
+		after = "0"
+		equal, equalParams = column.expression+" IS NULL", column.params
+	case !column.desc:
+		after, afterParams = column.expression+" > ?", append(append([]any{}, column.params...), value)
+		equal, equalParams = column.expression+" = ?", append(append([]any{}, column.params...), value)
+	default:
+		after = "(" + column.expression + " < ? OR " + column.expression + " IS NULL)"
+		afterParams = append(append(append([]any{}, column.params...), value), column.params...)
+		equal, equalParams = column.expression+" = ?", append(append([]any{}, column.params...), value)
+	}
+
+	if len(columns) == 1 {
+		return after, afterParams
+	}
+	rest, restParams := keysetClause(columns[1:], values[1:])
+	clause := "(" + after + " OR (" + equal + " AND " + rest + "))"
+	params := append(append(append([]any{}, afterParams...), equalParams...), restParams...)
+	return clause, params
+}
+
+// keysetIterator tracks the position of objects returned by an ObjectIterator, to produce continue tokens
+type keysetIterator struct {
+	revision int
+	// limit is the maximum number of objects to return, 0 for no limit
+	limit int
+	count int
+	// last holds the sort values and key of the last returned object
+	last []any
+	// more is true if objects after the last returned one exist
+	more bool
+}
+
+// token returns the continue token to resume after the last returned object, or "" if there are no more objects
+func (k *keysetIterator) token() (string, error) {
+	if !k.more {
+		return "", nil
+	}
+	values := []any{}
+	for _, value := range k.last {
+		// text values might be returned as bytes
+		if buf, ok := value.([]byte); ok {
+			value = string(buf)
+		}
+		values = append(values, value)
+	}
+	key, ok := values[len(values)-1].(string)
+	if !ok {
+		return "", errors.Errorf("Unexpected non-string key: %v", values[len(values)-1])
+	}
+	return continueToken{Revision: k.revision, Key: key, Values: values[:len(values)-1]}.encode()
+}
+
+// sortFieldExpression returns the expression objects are sorted by for a field, see ListByOptionsIter
+func sortFieldExpression(field []string) keysetColumn {
+	return keysetColumn{
+		expression: "(SELECT MIN(f.value) FROM fields f WHERE " + fieldMatchClause + ")",
+		params:     []any{toColumnName(field)},
+	}
+}
+
+// joinExpressions returns the expressions of columns, separated by commas and optionally followed by their sort
+// direction, along with their parameters
+func joinExpressions(columns []keysetColumn, withDirection bool) (string, []any) {
+	expressions := []string{}
+	params := []any{}
+	for _, column := range columns {
+		expression := column.expression
+		if withDirection && column.desc {
+			expression += " DESC"
+		} else if withDirection {
+			expression += " ASC"
+		}
+		expressions = append(expressions, expression)
+		params = append(params, column.params...)
+	}
+	return strings.Join(expressions, ", "), params
+}
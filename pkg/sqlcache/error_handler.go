@@ -0,0 +1,25 @@
+package sqlcache
+
+import (
+	"k8s.io/klog/v2"
+)
+
+// ErrorHandler handles errors occurring in methods whose signature does not allow returning them,
+// such as most methods of cache.Store and cache.ThreadSafeStore. If the ErrorHandler returns, such methods
+// return empty results. Any func(error) can be used as a callback, see WithErrorHandler
+type ErrorHandler func(err error)
+
+// PanicOnError is the default ErrorHandler, it panics
+func PanicOnError(err error) {
+	panic(err)
+}
+
+// LogOnError is an ErrorHandler that logs errors, letting methods return empty results
+func LogOnError(err error) {
+	klog.Errorf("%v", err)
+}
+
+// handleError handles an error with the configured ErrorHandler
+func (s *Store) handleError(err error) {
+	s.errorHandler(err)
+}
@@ -0,0 +1,56 @@
+package sqlcache
+
+import (
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/tools/cache"
+	"testing"
+)
+
+func TestErrorHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	// by default, errors panic
+	store, err := NewStore(testStoreObject{}, testStoreKeyFunc, TEST_DB_LOCATION)
+	assert.NoError(err)
+	assert.NoError(store.Close())
+	assert.Panics(func() { store.List() })
+	_, err = store.SafeList()
+	assert.Error(err)
+	_, err = store.SafeListKeys()
+	assert.Error(err)
+
+	// logging returns empty results
+	store, err = NewStore(testStoreObject{}, testStoreKeyFunc, TEST_DB_LOCATION, WithErrorHandler(LogOnError))
+	assert.NoError(err)
+	assert.NoError(store.Close())
+	assert.NotPanics(func() {
+		assert.Empty(store.List())
+		assert.Empty(store.ListKeys())
+	})
+
+	// custom callbacks get called
+	var handled []error
+	callback := func(err error) {
+		handled = append(handled, err)
+	}
+	ts, err := NewThreadSafeStore("", TEST_DB_LOCATION, cache.Indexers{}, WithErrorHandler(callback))
+	assert.NoError(err)
+	safe := ts.(SafeThreadSafeStore)
+	assert.NoError(safe.SafeAdd("a", "a"))
+	item, exists, err := safe.SafeGet("a")
+	assert.NoError(err)
+	assert.True(exists)
+	assert.Equal("a", item)
+	assert.NoError(safe.SafeDelete("a"))
+	_, exists, err = safe.SafeGet("a")
+	assert.NoError(err)
+	assert.False(exists)
+
+	assert.NoError(safe.(*threadSafeStore).Close())
+	ts.Add("b", "b")
+	_, exists = ts.Get("b")
+	assert.False(exists)
+	assert.Empty(ts.ListIndexFuncValues("none"))
+	assert.Len(handled, 3)
+	assert.Error(safe.SafeReplace(map[string]any{}, "1"))
+}
@@ -0,0 +1,88 @@
+package sqlcache
+
+import (
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/selection"
+	"strings"
+)
+
+// fieldSelectorFields returns the fields selector refers to, except those supported on all resources (see
+// objectMetaColumns), which do not need a FieldFunc
+func fieldSelectorFields(selector fields.Selector) [][]string {
+	if selector == nil {
+		return nil
+	}
+	result := [][]string{}
+	for _, requirement := range selector.Requirements() {
+		if _, ok := objectMetaColumns[requirement.Field]; !ok {
+			result = append(result, strings.Split(requirement.Field, "."))
+		}
+	}
+	return result
+}
+
+// fieldSelectorClauses returns WHERE clauses matching objects selected by selector, with their parameters.
+// metadata.name and metadata.namespace are supported on all resources, other fields need a FieldFunc. As in the
+// Kubernetes API, absent fields have an empty value, so they match <field>= and <field>!=<value>
+func (l *ListOptionIndexer) fieldSelectorClauses(selector fields.Selector) ([]string, []any, error) {
+	if selector == nil || selector.Empty() {
+		return nil, nil, nil
+	}
+	clauses := []string{}
+	params := []any{}
+	for _, requirement := range selector.Requirements() {
+		var negated bool
+		switch requirement.Operator {
+		case selection.Equals, selection.DoubleEquals:
+		case selection.NotEquals:
+			negated = true
+		default:
+			return nil, nil, errors.Errorf("Unsupported field selector operator %q", requirement.Operator)
+		}
+
+		if _, ok := objectMetaColumns[requirement.Field]; ok && l.fieldFuncs[requirement.Field] == nil {
+			clause, clauseParams := objectMetaClause(requirement.Field, requirement.Value, negated)
+			clauses = append(clauses, clause)
+			params = append(params, clauseParams...)
+			continue
+		}
+
+		for _, filter := range l.fieldSelectorFilters(requirement.Field, requirement.Value, negated) {
+			clause, filterParams, err := l.filterClause(filter)
+			if err != nil {
+				return nil, nil, errors.Wrapf(err, "Invalid field selector %q", selector.String())
+			}
+			clauses = append(clauses, clause)
+			params = append(params, filterParams...)
+		}
+	}
+	return clauses, params, nil
+}
+
+// fieldSelectorFilters returns Filters equivalent to a field selector requirement on a field with a FieldFunc
+func (l *ListOptionIndexer) fieldSelectorFilters(field string, value string, negated bool) []Filter {
+	if value != "" {
+		if negated {
+			return []Filter{NewFilterOp(field, FilterNotEquals, value)}
+		}
+		return []Filter{NewFilterOp(field, FilterEquals, value)}
+	}
+	if negated {
+		// non-empty
+		if l.fieldTypes[sanitize(field)] != StringField {
+			return []Filter{NewFilterOp(field, FilterExists)}
+		}
+		return []Filter{NewFilterOp(field, FilterExists), NewFilterOp(field, FilterNotEquals, "")}
+	}
+	return []Filter{l.emptyFieldFilter(field)}
+}
+
+// emptyFieldFilter returns a Filter matching objects where field is absent or, for StringFields, empty
+func (l *ListOptionIndexer) emptyFieldFilter(field string) Filter {
+	absent := NewFilterOp(field, FilterNotExists)
+	if l.fieldTypes[sanitize(field)] != StringField {
+		return absent
+	}
+	return NewOrFilter(absent, NewFilterOp(field, FilterEquals, ""))
+}
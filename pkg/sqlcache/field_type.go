@@ -0,0 +1,177 @@
+package sqlcache
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"math"
+	"strconv"
+	"time"
+)
+
+// FieldType determines how values of a field are stored, and therefore how they are compared and sorted
+type FieldType int
+
+const (
+	// StringField values are stored as text, see FieldFunc. Default for fields without a declared type
+	StringField FieldType = iota
+	// IntField values are stored as integers. FieldFuncs can return any integer type, up to math.MaxInt64, or a
+	// decimal string
+	IntField
+	// FloatField values are stored as floating point numbers. FieldFuncs can return any integer or float type,
+	// or a decimal string
+	FloatField
+	// BoolField values are stored as booleans, false sorting before true. FieldFuncs can return a bool or a string
+	// as accepted by strconv.ParseBool
+	BoolField
+	// TimeField values are stored as timestamps, compared and sorted chronologically regardless of time zone.
+	// FieldFuncs can return a time.Time, a metav1.Time (or pointers to them) or an RFC 3339 string
+	TimeField
+)
+
+// timeFieldLayout formats TimeField values in UTC with fixed width, so that text order is chronological order
+const timeFieldLayout = "2006-01-02T15:04:05.000000000Z"
+
+// String returns the name of t
+func (t FieldType) String() string {
+	switch t {
+	case StringField:
+		return "string"
+	case IntField:
+		return "int"
+	case FloatField:
+		return "float"
+	case BoolField:
+		return "bool"
+	case TimeField:
+		return "time"
+	}
+	return fmt.Sprintf("FieldType(%d)", int(t))
+}
+
+// toSQLValues converts value, as returned by a FieldFunc, to values to store, one per element of []string values.
+// Empty []string values are stored as nil, like absent values
+func (t FieldType) toSQLValues(value any) ([]any, error) {
+	elements, ok := value.([]string)
+	if !ok {
+		result, err := t.toSQL(value)
+		return []any{result}, err
+	}
+	if len(elements) == 0 {
+		return []any{nil}, nil
+	}
+	result := []any{}
+	for _, element := range elements {
+		converted, err := t.toSQL(element)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, converted)
+	}
+	return result, nil
+}
+
+// uintToInt64 converts value to the int64 IntFields are stored as, failing if it does not fit
+func uintToInt64(value uint64) (int64, error) {
+	if value > math.MaxInt64 {
+		return 0, errors.Errorf("FieldFunc returned a value overflowing %s fields: %d", IntField, value)
+	}
+	return int64(value), nil
+}
+
+// toSQL converts value, as returned by a FieldFunc, to a value to store
+func (t FieldType) toSQL(value any) (any, error) {
+	if value == nil {
+		return nil, nil
+	}
+	if s, ok := value.(string); ok && t != StringField {
+		return t.parse(s)
+	}
+
+	switch t {
+	case StringField:
+		switch typedValue := value.(type) {
+		case int, bool, string:
+			return fmt.Sprint(typedValue), nil
+		}
+	case IntField:
+		switch typedValue := value.(type) {
+		case int:
+			return int64(typedValue), nil
+		case int8:
+			return int64(typedValue), nil
+		case int16:
+			return int64(typedValue), nil
+		case int32:
+			return int64(typedValue), nil
+		case int64:
+			return typedValue, nil
+		case uint8:
+			return int64(typedValue), nil
+		case uint16:
+			return int64(typedValue), nil
+		case uint32:
+			return int64(typedValue), nil
+		case uint:
+			return uintToInt64(uint64(typedValue))
+		case uint64:
+			return uintToInt64(typedValue)
+		}
+	case FloatField:
+		switch typedValue := value.(type) {
+		case float32:
+			return float64(typedValue), nil
+		case float64:
+			return typedValue, nil
+		}
+		if i, err := IntField.toSQL(value); err == nil {
+			return float64(i.(int64)), nil
+		}
+	case BoolField:
+		if b, ok := value.(bool); ok {
+			return b, nil
+		}
+	case TimeField:
+		switch typedValue := value.(type) {
+		case time.Time:
+			return typedValue.UTC().Format(timeFieldLayout), nil
+		case *time.Time:
+			if typedValue == nil {
+				return nil, nil
+			}
+			return typedValue.UTC().Format(timeFieldLayout), nil
+		case metav1.Time:
+			return typedValue.UTC().Format(timeFieldLayout), nil
+		case *metav1.Time:
+			if typedValue == nil {
+				return nil, nil
+			}
+			return typedValue.UTC().Format(timeFieldLayout), nil
+		}
+	}
+	return nil, errors.Errorf("FieldFunc returned a value not supported by %s fields: %v", t, value)
+}
+
+// parse converts s, eg. a filter match, to a value comparable with stored ones
+func (t FieldType) parse(s string) (any, error) {
+	switch t {
+	case StringField:
+		return s, nil
+	case IntField:
+		result, err := strconv.ParseInt(s, 10, 64)
+		return result, errors.Wrapf(err, "Invalid int value %q", s)
+	case FloatField:
+		result, err := strconv.ParseFloat(s, 64)
+		return result, errors.Wrapf(err, "Invalid float value %q", s)
+	case BoolField:
+		result, err := strconv.ParseBool(s)
+		return result, errors.Wrapf(err, "Invalid bool value %q", s)
+	case TimeField:
+		result, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid time value %q", s)
+		}
+		return result.UTC().Format(timeFieldLayout), nil
+	}
+	return nil, errors.Errorf("Unknown field type %d", t)
+}
@@ -0,0 +1,281 @@
+package sqlcache
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/pkg/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// compactedVersionMetadata is the name of the metadata entry holding the highest version of deleted history rows,
+// including their deletion version and the version that superseded them. History is only complete after it, see Watch
+const compactedVersionMetadata = "compacted_version"
+
+// RetentionPolicy determines which past versions are deleted by a VersionedIndexer's garbage collector.
+// The latest version of existing objects is always kept. Any other version is deleted if it falls outside any of
+// the configured limits. Zero values disable the corresponding limit
+type RetentionPolicy struct {
+	// MaxVersionsPerKey is the number of most recent versions kept for each key, including any deletion tombstone
+	MaxVersionsPerKey int
+	// MaxAge is how long versions are kept after having been stored
+	MaxAge time.Duration
+	// VersionWindow is the number of versions kept before the latest version stored across all keys.
+	// Versions lower than or equal to the latest version minus VersionWindow are deleted
+	VersionWindow int
+	// TombstoneTTL is how long deleted objects are kept after deletion, including all their versions
+	TombstoneTTL time.Duration
+
+	// Interval is the period between garbage collector runs in the background. If zero, only CollectGarbage runs it
+	Interval time.Duration
+	// BatchSize is the number of keys processed in each transaction, 100 if zero. Transactions are kept small so that
+	// other writes are not blocked for long
+	BatchSize int
+}
+
+// GarbageCollectionStats reports on garbage collector runs since the VersionedIndexer was created
+type GarbageCollectionStats struct {
+	// Runs is the number of completed runs
+	Runs int64
+	// ReclaimedRows is the total number of deleted versions
+	ReclaimedRows int64
+	// LastRun is when the last completed run started
+	LastRun time.Time
+	// LastRunDuration is how long the last completed run took
+	LastRunDuration time.Duration
+	// LastRunReclaimedRows is the number of versions deleted by the last completed run
+	LastRunReclaimedRows int64
+}
+
+// garbageCollector deletes past versions from a VersionedIndexer according to a RetentionPolicy
+type garbageCollector struct {
+	v      *VersionedIndexer
+	policy RetentionPolicy
+
+	listKeysStmt               *sql.Stmt
+	maxVersionStmt             *sql.Stmt
+	collectStmt                *sql.Stmt
+	updateCompactedVersionStmt *sql.Stmt
+
+	// lock serializes runs and protects stats
+	lock  sync.Mutex
+	stats GarbageCollectionStats
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// newGarbageCollector returns a garbageCollector for v
+func newGarbageCollector(v *VersionedIndexer, policy RetentionPolicy) (*garbageCollector, error) {
+	if policy.BatchSize <= 0 {
+		policy.BatchSize = 100
+	}
+	gc := &garbageCollector{
+		v:      v,
+		policy: policy,
+	}
+
+	p := &statementPreparer{store: v.Store}
+	gc.listKeysStmt = p.prepare(`SELECT DISTINCT key FROM object_history WHERE key > ? ORDER BY key LIMIT ?`)
+	gc.maxVersionStmt = p.prepareRead(`SELECT COALESCE(MAX(version), 0) FROM object_history`)
+	// versions are ranked per key, latest first. The latest is a tombstone if it has a deleted_at timestamp
+	gc.collectStmt = p.prepare(`DELETE FROM object_history WHERE rowid IN (
+		SELECT rowid FROM (
+			SELECT rowid, version, created_at,
+				ROW_NUMBER() OVER w AS rank,
+				FIRST_VALUE(deleted_at) OVER w AS tombstone_deleted_at
+			FROM object_history
+			WHERE key >= ? AND key <= ?
+			WINDOW w AS (PARTITION BY key ORDER BY version DESC)
+		)
+		WHERE tombstone_deleted_at < ?
+			OR (rank > 1 AND (rank > ? OR created_at < ? OR version <= ?))
+	)
+	RETURNING MAX(version, COALESCE(deleted_version, 0), COALESCE((
+		SELECT MIN(h.version) FROM object_history h WHERE h.key = object_history.key AND h.version > object_history.version
+	), 0))`)
+	gc.updateCompactedVersionStmt = p.prepare(`INSERT INTO metadata(name, value) VALUES ('` + compactedVersionMetadata + `', ?)
+		ON CONFLICT DO UPDATE SET value = excluded.value
+			WHERE CAST(excluded.value AS INTEGER) > CAST(metadata.value AS INTEGER)`)
+	if p.err != nil {
+		return nil, p.err
+	}
+
+	return gc, nil
+}
+
+// start runs the garbage collector every policy.Interval in the background, until stop is called
+func (gc *garbageCollector) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	gc.cancel = cancel
+	gc.done = make(chan struct{})
+
+	go func() {
+		defer close(gc.done)
+		ticker := time.NewTicker(gc.policy.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				_, err := gc.run(ctx)
+				if err != nil && ctx.Err() == nil {
+					gc.v.handleError(errors.Wrap(err, "Unexpected error collecting garbage"))
+				}
+			}
+		}
+	}()
+}
+
+// stop stops background runs, waiting for any run in progress to terminate
+func (gc *garbageCollector) stop() {
+	if gc.cancel == nil {
+		return
+	}
+	gc.cancel()
+	<-gc.done
+}
+
+// run deletes versions according to the policy, one batch of keys per transaction, returning the number of
+// deleted versions
+func (gc *garbageCollector) run(ctx context.Context) (int64, error) {
+	gc.lock.Lock()
+	defer gc.lock.Unlock()
+
+	start := gc.v.now()
+	// disabled limits never match
+	maxVersions := int64(math.MaxInt64)
+	if gc.policy.MaxVersionsPerKey > 0 {
+		maxVersions = int64(gc.policy.MaxVersionsPerKey)
+	}
+	createdBefore := int64(math.MinInt64)
+	if gc.policy.MaxAge > 0 {
+		createdBefore = start.Add(-gc.policy.MaxAge).Unix()
+	}
+	deletedBefore := int64(math.MinInt64)
+	if gc.policy.TombstoneTTL > 0 {
+		deletedBefore = start.Add(-gc.policy.TombstoneTTL).Unix()
+	}
+	maxCollectedVersion := int64(math.MinInt64)
+	if gc.policy.VersionWindow > 0 {
+		err := gc.maxVersionStmt.QueryRowContext(ctx).Scan(&maxCollectedVersion)
+		if err != nil {
+			return 0, err
+		}
+		maxCollectedVersion -= int64(gc.policy.VersionWindow)
+	}
+
+	var reclaimed int64
+	lastKey := ""
+	for {
+		tx, err := gc.v.db.BeginTx(ctx, nil)
+		if err != nil {
+			return reclaimed, err
+		}
+		keys, err := gc.v.queryStrings(ctx, tx.Stmt(gc.listKeysStmt), lastKey, gc.policy.BatchSize)
+		if err != nil {
+			return reclaimed, gc.v.rollback(err, tx)
+		}
+		if len(keys) == 0 {
+			err = tx.Commit()
+			if err != nil {
+				return reclaimed, err
+			}
+			break
+		}
+
+		affected, compactedVersion, err := gc.collect(ctx, tx, keys[0], keys[len(keys)-1],
+			deletedBefore, maxVersions, createdBefore, maxCollectedVersion)
+		if err != nil {
+			return reclaimed, gc.v.rollback(err, tx)
+		}
+		if affected > 0 {
+			_, err = tx.Stmt(gc.updateCompactedVersionStmt).ExecContext(ctx, strconv.FormatInt(compactedVersion, 10))
+			if err != nil {
+				return reclaimed, gc.v.rollback(err, tx)
+			}
+		}
+		err = tx.Commit()
+		if err != nil {
+			return reclaimed, err
+		}
+
+		reclaimed += affected
+		lastKey = keys[len(keys)-1]
+	}
+
+	gc.stats.Runs++
+	gc.stats.ReclaimedRows += reclaimed
+	gc.stats.LastRun = start
+	gc.stats.LastRunDuration = gc.v.now().Sub(start)
+	gc.stats.LastRunReclaimedRows = reclaimed
+	return reclaimed, nil
+}
+
+// collect deletes versions of keys between firstKey and lastKey as part of tx, returning how many were deleted and the
+// highest version, deletion version or superseding version among them
+func (gc *garbageCollector) collect(ctx context.Context, tx *sql.Tx, firstKey string, lastKey string, params ...any) (int64, int64, error) {
+	rows, err := tx.Stmt(gc.collectStmt).QueryContext(ctx, append([]any{firstKey, lastKey}, params...)...)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer rows.Close()
+
+	var affected, compactedVersion int64
+	for rows.Next() {
+		var version int64
+		err = rows.Scan(&version)
+		if err != nil {
+			return 0, 0, err
+		}
+		affected++
+		if version > compactedVersion {
+			compactedVersion = version
+		}
+	}
+	return affected, compactedVersion, rows.Err()
+}
+
+// checkNotCompacted returns an error satisfying apierrors.IsResourceExpired if history after version might have been
+// deleted by the garbage collector. If tx is not nil, it is queried as part of it
+func (v *VersionedIndexer) checkNotCompacted(ctx context.Context, version int, tx *sql.Tx) error {
+	encoded, err := v.getMetadata(ctx, compactedVersionMetadata, tx)
+	if err != nil {
+		return err
+	}
+	if encoded == "" {
+		return nil
+	}
+	compactedVersion, err := strconv.Atoi(encoded)
+	if err != nil {
+		return errors.Wrapf(err, "Unexpected non-integer compacted version: %s", encoded)
+	}
+	if version < compactedVersion {
+		return apierrors.NewResourceExpired(fmt.Sprintf("too old resource version: %d (%d)", version, compactedVersion))
+	}
+	return nil
+}
+
+// CollectGarbage deletes past versions according to the RetentionPolicy set via WithRetentionPolicy, returning
+// the number of deleted versions. It is a no-op if no RetentionPolicy was set
+func (v *VersionedIndexer) CollectGarbage(ctx context.Context) (int64, error) {
+	if v.gc == nil {
+		return 0, nil
+	}
+	return v.gc.run(ctx)
+}
+
+// GarbageCollectionStats returns statistics about garbage collector runs
+func (v *VersionedIndexer) GarbageCollectionStats() GarbageCollectionStats {
+	if v.gc == nil {
+		return GarbageCollectionStats{}
+	}
+	v.gc.lock.Lock()
+	defer v.gc.lock.Unlock()
+	return v.gc.stats
+}
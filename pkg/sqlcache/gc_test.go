@@ -0,0 +1,165 @@
+package sqlcache
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func testGCPod(name string, revision int) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            name,
+			ResourceVersion: strconv.Itoa(revision),
+			Labels: map[string]string{
+				"Brand": "ferrari",
+				"Color": "red",
+			},
+		},
+	}
+}
+
+// testGCCount returns the number of rows in table
+func testGCCount(t *testing.T, l *ListOptionIndexer, table string) int {
+	var result int
+	assert.NoError(t, l.db.QueryRow(`SELECT COUNT(*) FROM `+table).Scan(&result))
+	return result
+}
+
+func TestGarbageCollectionMaxVersionsPerKey(t *testing.T) {
+	assert := assert.New(t)
+
+	l, err := NewListOptionIndexer(&v1.Pod{}, TEST_DB_LOCATION, fieldFunc, WithRetentionPolicy(RetentionPolicy{
+		MaxVersionsPerKey: 2,
+		BatchSize:         1,
+	}))
+	assert.NoError(err)
+
+	assert.NoError(l.Add(testGCPod("a", 1)))
+	assert.NoError(l.Add(testGCPod("a", 2)))
+	assert.NoError(l.Add(testGCPod("a", 3)))
+	assert.NoError(l.Add(testGCPod("b", 4)))
+	assert.NoError(l.Add(testGCPod("c", 5)))
+	assert.NoError(l.Delete(testGCPod("c", 5)))
+	assert.Equal(5, testGCCount(t, l, "object_history"))
+	assert.Equal(10, testGCCount(t, l, "fields"))
+
+	reclaimed, err := l.CollectGarbage(context.Background())
+	assert.NoError(err)
+	assert.Equal(int64(1), reclaimed)
+	assert.Equal(4, testGCCount(t, l, "object_history"))
+	assert.Equal(8, testGCCount(t, l, "fields"))
+
+	_, exists, err := l.GetByKeyAndVersion("a", 1)
+	assert.NoError(err)
+	assert.False(exists)
+	_, exists, err = l.GetByKeyAndVersion("a", 2)
+	assert.NoError(err)
+	assert.True(exists)
+	assert.ElementsMatch([]string{"a", "b"}, l.ListKeys())
+	list, err := l.ListByOptions(ListOptions{})
+	assert.NoError(err)
+	assert.Len(list, 2)
+
+	// nothing left to collect
+	reclaimed, err = l.CollectGarbage(context.Background())
+	assert.NoError(err)
+	assert.Equal(int64(0), reclaimed)
+
+	stats := l.GarbageCollectionStats()
+	assert.Equal(int64(2), stats.Runs)
+	assert.Equal(int64(1), stats.ReclaimedRows)
+	assert.Equal(int64(0), stats.LastRunReclaimedRows)
+
+	assert.NoError(l.Close())
+}
+
+func TestGarbageCollectionMaxAgeAndTombstoneTTL(t *testing.T) {
+	assert := assert.New(t)
+
+	l, err := NewListOptionIndexer(&v1.Pod{}, TEST_DB_LOCATION, fieldFunc, WithRetentionPolicy(RetentionPolicy{
+		MaxAge:       time.Hour,
+		TombstoneTTL: 3 * time.Hour,
+	}))
+	assert.NoError(err)
+	now := time.Unix(1700000000, 0)
+	l.now = func() time.Time { return now }
+
+	assert.NoError(l.Add(testGCPod("a", 1)))
+	assert.NoError(l.Add(testGCPod("b", 2)))
+	now = now.Add(2 * time.Hour)
+	assert.NoError(l.Add(testGCPod("a", 3)))
+	assert.NoError(l.Delete(testGCPod("b", 2)))
+
+	// old versions are collected, latest versions and recent tombstones are not
+	reclaimed, err := l.CollectGarbage(context.Background())
+	assert.NoError(err)
+	assert.Equal(int64(1), reclaimed)
+	_, exists, err := l.GetByKeyAndVersion("a", 1)
+	assert.NoError(err)
+	assert.False(exists)
+
+	now = now.Add(2 * time.Hour)
+	reclaimed, err = l.CollectGarbage(context.Background())
+	assert.NoError(err)
+	assert.Equal(int64(0), reclaimed)
+
+	// tombstones are collected after their TTL
+	now = now.Add(2 * time.Hour)
+	reclaimed, err = l.CollectGarbage(context.Background())
+	assert.NoError(err)
+	assert.Equal(int64(1), reclaimed)
+	assert.Equal(1, testGCCount(t, l, "object_history"))
+	_, exists, err = l.GetByKeyAndVersion("a", 3)
+	assert.NoError(err)
+	assert.True(exists)
+
+	assert.NoError(l.Close())
+}
+
+func TestGarbageCollectionVersionWindow(t *testing.T) {
+	assert := assert.New(t)
+
+	l, err := NewListOptionIndexer(&v1.Pod{}, TEST_DB_LOCATION, fieldFunc, WithRetentionPolicy(RetentionPolicy{
+		VersionWindow: 2,
+	}))
+	assert.NoError(err)
+
+	for revision := 1; revision <= 5; revision++ {
+		assert.NoError(l.Add(testGCPod("a", revision)))
+	}
+
+	// versions 1 to 3 are outside the window
+	reclaimed, err := l.CollectGarbage(context.Background())
+	assert.NoError(err)
+	assert.Equal(int64(3), reclaimed)
+	for revision := 1; revision <= 5; revision++ {
+		_, exists, err := l.GetByKeyAndVersion("a", revision)
+		assert.NoError(err)
+		assert.Equal(revision > 3, exists)
+	}
+
+	assert.NoError(l.Close())
+}
+
+func TestGarbageCollectionInBackground(t *testing.T) {
+	assert := assert.New(t)
+
+	l, err := NewListOptionIndexer(&v1.Pod{}, TEST_DB_LOCATION, fieldFunc, WithRetentionPolicy(RetentionPolicy{
+		MaxVersionsPerKey: 1,
+		Interval:          10 * time.Millisecond,
+	}))
+	assert.NoError(err)
+
+	assert.NoError(l.Add(testGCPod("a", 1)))
+	assert.NoError(l.Add(testGCPod("a", 2)))
+	assert.Eventually(func() bool {
+		return l.GarbageCollectionStats().ReclaimedRows == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.NoError(l.Close())
+}
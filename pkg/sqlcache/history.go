@@ -0,0 +1,122 @@
+package sqlcache
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"reflect"
+)
+
+// ObjectVersion describes a version of an object stored by a VersionedIndexer
+type ObjectVersion struct {
+	// Version is the version of the object
+	Version int
+	// Deleted is true if the object was deleted after this version, without further versions in between
+	Deleted bool
+	// DeletedVersion is the version the object was deleted at, if Deleted
+	DeletedVersion int
+}
+
+// ListVersions returns all stored versions of the object associated with key, oldest first.
+// Versions deleted by the garbage collector are not returned
+func (v *VersionedIndexer) ListVersions(key string) ([]ObjectVersion, error) {
+	err := v.flush()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := v.listVersionsStmt.Query(key)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := []ObjectVersion{}
+	for rows.Next() {
+		var version ObjectVersion
+		err = rows.Scan(&version.Version, &version.Deleted, &version.DeletedVersion)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, version)
+	}
+	return result, rows.Err()
+}
+
+// GetAtOrBefore returns the object associated with key as it was at version, that is, its latest version
+// not greater than version, unless it was deleted in between
+func (v *VersionedIndexer) GetAtOrBefore(key string, version int) (item any, exists bool, err error) {
+	result, err := v.QueryObjects(v.getAtOrBeforeStmt, key, key, version, version)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if len(result) == 0 {
+		return nil, false, nil
+	}
+
+	return result[0], true, nil
+}
+
+// Diff returns a JSON merge patch (RFC 7386) that transforms the object associated with key at fromVersion into the
+// one at toVersion. Both versions must be stored, see GetByKeyAndVersion
+func (v *VersionedIndexer) Diff(key string, fromVersion int, toVersion int) ([]byte, error) {
+	from, err := v.versionJSON(key, fromVersion)
+	if err != nil {
+		return nil, err
+	}
+	to, err := v.versionJSON(key, toVersion)
+	if err != nil {
+		return nil, err
+	}
+	patch, changed := mergePatch(from, to)
+	if !changed {
+		return []byte("{}"), nil
+	}
+	return json.Marshal(patch)
+}
+
+// versionJSON returns a generic JSON representation of the object associated with key and version
+func (v *VersionedIndexer) versionJSON(key string, version int) (any, error) {
+	item, exists, err := v.GetByKeyAndVersion(key, version)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errors.Errorf("Version %d of %s not found", version, key)
+	}
+	buf, err := json.Marshal(item)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error while converting version %d of %s to JSON", version, key)
+	}
+	var result any
+	err = json.Unmarshal(buf, &result)
+	return result, err
+}
+
+// mergePatch returns the JSON merge patch transforming from into to, and whether they differ at all.
+// Objects are patched recursively, any other value is replaced as a whole
+func mergePatch(from any, to any) (any, bool) {
+	fromMap, fromIsMap := from.(map[string]any)
+	toMap, toIsMap := to.(map[string]any)
+	if !fromIsMap || !toIsMap {
+		return to, !reflect.DeepEqual(from, to)
+	}
+
+	result := map[string]any{}
+	for name, fromValue := range fromMap {
+		toValue, ok := toMap[name]
+		if !ok {
+			result[name] = nil
+			continue
+		}
+		patch, changed := mergePatch(fromValue, toValue)
+		if changed {
+			result[name] = patch
+		}
+	}
+	for name, toValue := range toMap {
+		if _, ok := fromMap[name]; !ok {
+			result[name] = toValue
+		}
+	}
+	return result, len(result) > 0
+}
@@ -0,0 +1,57 @@
+package sqlcache
+
+import (
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"testing"
+)
+
+func TestHistory(t *testing.T) {
+	assert := assert.New(t)
+
+	l, err := NewListOptionIndexer(&v1.Pod{}, TEST_DB_LOCATION, fieldFunc)
+	assert.NoError(err)
+	pod := func(revision string, labels map[string]string) *v1.Pod {
+		return &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "red", ResourceVersion: revision, Labels: labels}}
+	}
+
+	assert.NoError(l.Add(pod("1", map[string]string{"Color": "red", "Brand": "ferrari"})))
+	assert.NoError(l.Add(pod("2", map[string]string{"Color": "blue", "Owner": "me"})))
+	assert.NoError(l.Delete(pod("4", nil)))
+	assert.NoError(l.Add(pod("6", nil)))
+
+	versions, err := l.ListVersions("red")
+	assert.NoError(err)
+	assert.Equal([]ObjectVersion{
+		{Version: 1},
+		{Version: 2, Deleted: true, DeletedVersion: 4},
+		{Version: 6},
+	}, versions)
+	versions, err = l.ListVersions("blue")
+	assert.NoError(err)
+	assert.Empty(versions)
+
+	for version, expected := range map[int]string{0: "", 1: "1", 3: "2", 4: "", 5: "", 7: "6"} {
+		item, exists, err := l.GetAtOrBefore("red", version)
+		assert.NoError(err)
+		assert.Equal(expected != "", exists, version)
+		if exists {
+			assert.Equal(expected, item.(*v1.Pod).ResourceVersion)
+		}
+	}
+
+	patch, err := l.Diff("red", 1, 2)
+	assert.NoError(err)
+	assert.JSONEq(`{"metadata":{"resourceVersion":"2","labels":{"Color":"blue","Brand":null,"Owner":"me"}}}`, string(patch))
+	patch, err = l.Diff("red", 2, 6)
+	assert.NoError(err)
+	assert.JSONEq(`{"metadata":{"resourceVersion":"6","labels":null}}`, string(patch))
+	patch, err = l.Diff("red", 1, 1)
+	assert.NoError(err)
+	assert.JSONEq(`{}`, string(patch))
+	_, err = l.Diff("red", 1, 3)
+	assert.Error(err)
+
+	assert.NoError(l.Close())
+}
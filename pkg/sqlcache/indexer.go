@@ -1,6 +1,7 @@
 package sqlcache
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	_ "github.com/mattn/go-sqlite3"
@@ -22,7 +23,7 @@ type Indexer struct {
 }
 
 // NewIndexer returns a cache.Indexer backed by SQLite for objects of the given example type
-func NewIndexer(example any, keyFunc cache.KeyFunc, path string, indexers cache.Indexers) (*Indexer, error) {
+func NewIndexer(example any, keyFunc cache.KeyFunc, path string, indexers cache.Indexers, opts ...Option) (*Indexer, error) {
 	// sanity checks first
 	for key := range indexers {
 		if strings.Contains(key, `"`) {
@@ -30,12 +31,21 @@ func NewIndexer(example any, keyFunc cache.KeyFunc, path string, indexers cache.
 		}
 	}
 
-	s, err := NewStore(example, keyFunc, path)
+	s, err := NewStore(example, keyFunc, path, opts...)
 	if err != nil {
 		return nil, err
 	}
 
-	err = s.InitExec(`CREATE TABLE indices (
+	indexNames := []string{}
+	for key := range indexers {
+		indexNames = append(indexNames, key)
+	}
+	err = s.InitFingerprint("indexers", namesFingerprint(indexNames))
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.InitExec(`CREATE TABLE IF NOT EXISTS indices (
 			name VARCHAR NOT NULL,
 			value VARCHAR NOT NULL,
 			key VARCHAR NOT NULL REFERENCES objects(key) ON DELETE CASCADE,
@@ -44,7 +54,7 @@ func NewIndexer(example any, keyFunc cache.KeyFunc, path string, indexers cache.
 	if err != nil {
 		return nil, err
 	}
-	err = s.InitExec(`CREATE INDEX indices_name_value_index ON indices(name, value)`)
+	err = s.InitExec(`CREATE INDEX IF NOT EXISTS indices_name_value_index ON indices(name, value)`)
 	if err != nil {
 		return nil, err
 	}
@@ -55,15 +65,19 @@ func NewIndexer(example any, keyFunc cache.KeyFunc, path string, indexers cache.
 	}
 	i.RegisterAfterUpsert(i.AfterUpsert)
 
-	i.deleteIndicesStmt = s.Prepare(`DELETE FROM indices WHERE key = ?`)
-	i.addIndexStmt = s.Prepare(`INSERT INTO indices(name, value, key) VALUES (?, ?, ?)`)
-	i.listByIndexStmt = s.Prepare(`SELECT object FROM objects
+	p := &statementPreparer{store: s}
+	i.deleteIndicesStmt = p.prepare(`DELETE FROM indices WHERE key = ?`)
+	i.addIndexStmt = p.prepare(`INSERT INTO indices(name, value, key) VALUES (?, ?, ?)`)
+	i.listByIndexStmt = p.prepareRead(`SELECT object FROM objects
 			WHERE key IN (
 			    SELECT key FROM indices
 			    	WHERE name = ? AND value = ?
 			)`)
-	i.listKeysByIndexStmt = s.Prepare(`SELECT DISTINCT key FROM indices WHERE name = ? AND value = ?`)
-	i.listIndexValuesStmt = s.Prepare(`SELECT DISTINCT value FROM indices WHERE name = ?`)
+	i.listKeysByIndexStmt = p.prepareRead(`SELECT DISTINCT key FROM indices WHERE name = ? AND value = ?`)
+	i.listIndexValuesStmt = p.prepareRead(`SELECT DISTINCT value FROM indices WHERE name = ?`)
+	if p.err != nil {
+		return nil, p.err
+	}
 
 	return i, nil
 }
@@ -127,7 +141,11 @@ func (i *Indexer) Index(indexName string, obj any) ([]any, error) {
 						WHERE name = ? AND value IN (?%s)
 				)
 		`, strings.Repeat(", ?", len(values)-1))
-	stmt := i.Prepare(query)
+	stmt, err := i.SafePrepareRead(query)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
 
 	// HACK: Query will accept []any but not []string
 	params := []any{indexName}
@@ -141,7 +159,17 @@ func (i *Indexer) Index(indexName string, obj any) ([]any, error) {
 // ByIndex returns the stored objects whose set of indexed values
 // for the named index includes the given indexed value
 func (i *Indexer) ByIndex(indexName, indexedValue string) ([]any, error) {
-	return i.QueryObjects(i.listByIndexStmt, indexName, indexedValue)
+	return i.ByIndexContext(context.Background(), indexName, indexedValue)
+}
+
+// ByIndexContext is like ByIndex, but stops querying when ctx is done
+func (i *Indexer) ByIndexContext(ctx context.Context, indexName, indexedValue string) ([]any, error) {
+	return i.QueryObjectsContext(ctx, i.listByIndexStmt, indexName, indexedValue)
+}
+
+// ByIndexIter is like ByIndexContext, but returns an iterator decoding objects one at a time
+func (i *Indexer) ByIndexIter(ctx context.Context, indexName, indexedValue string) (*ObjectIterator, error) {
+	return i.QueryObjectsIter(ctx, i.listByIndexStmt, indexName, indexedValue)
 }
 
 // IndexKeys returns a list of the Store keys of the objects whose indexed values in the given index include the given indexed value
@@ -154,11 +182,12 @@ func (i *Indexer) IndexKeys(indexName, indexedValue string) ([]string, error) {
 	return i.QueryStrings(i.listKeysByIndexStmt, indexName, indexedValue)
 }
 
-// ListIndexFuncValues wraps SafeListIndexFuncValues and panics in case of I/O errors
+// ListIndexFuncValues wraps SafeListIndexFuncValues and handles I/O errors via the ErrorHandler (by default panicking)
 func (i *Indexer) ListIndexFuncValues(name string) []string {
 	result, err := i.SafeListIndexFuncValues(name)
 	if err != nil {
-		panic(errors.Wrap(err, "Unexpected error in SafeListIndexFuncValues"))
+		i.handleError(errors.Wrap(err, "Unexpected error in SafeListIndexFuncValues"))
+		return []string{}
 	}
 	return result
 }
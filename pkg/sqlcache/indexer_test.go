@@ -165,14 +165,18 @@ func testStoreIndexMultiFunc(obj interface{}) ([]string, error) {
 }
 
 func TestIndexer(t *testing.T) {
-	store, err := NewIndexer(testStoreObject{}, testStoreKeyFunc, TEST_DB_LOCATION, testStoreIndexers())
-	if err != nil {
-		t.Error(err)
-	}
-	doTestIndex(t, store)
-	err = store.Close()
-	if err != nil {
-		return
+	for name, codec := range testCodecs() {
+		t.Run(name, func(t *testing.T) {
+			store, err := NewIndexer(testStoreObject{}, testStoreKeyFunc, TEST_DB_LOCATION, testStoreIndexers(), WithCodec(codec))
+			if err != nil {
+				t.Error(err)
+			}
+			doTestIndex(t, store)
+			err = store.Close()
+			if err != nil {
+				return
+			}
+		})
 	}
 }
 
@@ -184,29 +188,34 @@ func testVersionFunc(obj any) (int, error) {
 }
 
 func TestVersionedIndexer(t *testing.T) {
-	store, err := NewVersionedIndexer(testStoreObject{}, testStoreKeyFunc, testVersionFunc, TEST_DB_LOCATION, testStoreIndexers())
-	if err != nil {
-		t.Error(err)
-	}
-	doTestIndex(t, store)
+	for name, codec := range testCodecs() {
+		t.Run(name, func(t *testing.T) {
+			currentVersion = 0
+			store, err := NewVersionedIndexer(testStoreObject{}, testStoreKeyFunc, testVersionFunc, TEST_DB_LOCATION, testStoreIndexers(), WithCodec(codec))
+			if err != nil {
+				t.Error(err)
+			}
+			doTestIndex(t, store)
 
-	assert := assert.New(t)
+			assert := assert.New(t)
 
-	item, found, err := store.GetByKeyAndVersion("g", 4)
-	assert.Equal(true, found)
-	assert.Equal("g", item.(testStoreObject).Id)
-	assert.Equal("h", item.(testStoreObject).Val)
+			item, found, err := store.GetByKeyAndVersion("g", 4)
+			assert.Equal(true, found)
+			assert.Equal("g", item.(testStoreObject).Id)
+			assert.Equal("h", item.(testStoreObject).Val)
 
-	item, found, err = store.GetByKeyAndVersion("g", 5)
-	assert.Equal(true, found)
-	assert.Equal("g", item.(testStoreObject).Id)
-	assert.Equal("h2", item.(testStoreObject).Val)
+			item, found, err = store.GetByKeyAndVersion("g", 5)
+			assert.Equal(true, found)
+			assert.Equal("g", item.(testStoreObject).Id)
+			assert.Equal("h2", item.(testStoreObject).Val)
 
-	item, found, err = store.GetByKeyAndVersion("g", 6)
-	assert.Equal(false, found)
+			item, found, err = store.GetByKeyAndVersion("g", 6)
+			assert.Equal(false, found)
 
-	err = store.Close()
-	if err != nil {
-		return
+			err = store.Close()
+			if err != nil {
+				return
+			}
+		})
 	}
 }
@@ -0,0 +1,180 @@
+package sqlcache
+
+import (
+	"context"
+	"database/sql"
+	"github.com/pkg/errors"
+)
+
+// ObjectIterator iterates over the objects returned by a query, decoding them one at a time so that memory usage
+// stays bounded regardless of the result size. Typical use:
+//
+//	it, err := store.ListIter(ctx)
+//	...
+//	defer it.Close()
+//	for it.Next() {
+//		obj := it.Object()
+//		...
+//	}
+//	err = it.Err()
+//
+// An ObjectIterator holds a database connection until closed, so it must always be closed
+type ObjectIterator struct {
+	store *Store
+	ctx   context.Context
+	rows  *sql.Rows
+	// stmt is closed along with rows, if the iterator owns it
+	stmt *sql.Stmt
+	// keyset, if not nil, limits the number of objects and tracks their position, see Continue
+	keyset *keysetIterator
+
+	current any
+	err     error
+}
+
+// QueryObjectsIter runs a prepared statement that returns encoded objects of type typ, returning an iterator over them
+func (s *Store) QueryObjectsIter(ctx context.Context, stmt *sql.Stmt, params ...any) (*ObjectIterator, error) {
+	err := s.flush()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := stmt.QueryContext(ctx, params...)
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectIterator{store: s, ctx: ctx, rows: rows}, nil
+}
+
+// queryObjectsIterOwningStmt is like QueryObjectsIter, but the iterator also closes stmt when closed
+func (s *Store) queryObjectsIterOwningStmt(ctx context.Context, stmt *sql.Stmt, params ...any) (*ObjectIterator, error) {
+	it, err := s.QueryObjectsIter(ctx, stmt, params...)
+	if err != nil {
+		cerr := stmt.Close()
+		if cerr != nil {
+			return nil, errors.Wrap(cerr, "while handling "+err.Error())
+		}
+		return nil, err
+	}
+	it.stmt = stmt
+	return it, nil
+}
+
+// ListIter returns an iterator over all the currently known objects
+func (s *Store) ListIter(ctx context.Context) (*ObjectIterator, error) {
+	return s.QueryObjectsIter(ctx, s.listStmt)
+}
+
+// Next decodes the next object, returning false when there are no more objects or an error occurred (see Err)
+func (it *ObjectIterator) Next() bool {
+	it.current = nil
+	if it.err == nil {
+		// the driver notices cancellation asynchronously, so it is checked here to stop right away
+		it.err = it.ctx.Err()
+	}
+	if it.err != nil {
+		return false
+	}
+	if it.keyset != nil && it.keyset.limit > 0 && it.keyset.count == it.keyset.limit {
+		// one more row is queried to know whether a continue token is needed
+		it.keyset.more = it.rows.Next()
+		return false
+	}
+	if !it.rows.Next() {
+		return false
+	}
+
+	var buf sql.RawBytes
+	dest := []any{&buf}
+	if it.keyset != nil {
+		// sort values and the key follow the object
+		columns, err := it.rows.Columns()
+		if err != nil {
+			it.err = err
+			return false
+		}
+		it.keyset.last = make([]any, len(columns)-1)
+		for i := range it.keyset.last {
+			dest = append(dest, &it.keyset.last[i])
+		}
+		it.keyset.count++
+	}
+	err := it.rows.Scan(dest...)
+	if err != nil {
+		it.err = err
+		return false
+	}
+	it.current, it.err = it.store.fromBytes(buf)
+	return it.err == nil
+}
+
+// Object returns the object decoded by the last call to Next
+func (it *ObjectIterator) Object() any {
+	return it.current
+}
+
+// Continue returns a token to list the objects after the last one returned, via ListOptions.Resume, or "" if
+// there are none. It is only meaningful for iterators returned by ListByOptionsIter after Next returned false
+func (it *ObjectIterator) Continue() (string, error) {
+	if it.keyset == nil {
+		return "", nil
+	}
+	return it.keyset.token()
+}
+
+// Err returns the error that stopped iteration, if any
+func (it *ObjectIterator) Err() error {
+	if it.err != nil {
+		return it.err
+	}
+	return it.rows.Err()
+}
+
+// Close releases resources associated to this iterator. It is safe to call it more than once
+func (it *ObjectIterator) Close() error {
+	err := it.rows.Close()
+	if it.stmt != nil {
+		serr := it.stmt.Close()
+		if err == nil {
+			err = serr
+		}
+		it.stmt = nil
+	}
+	return err
+}
+
+// ForEach calls f on each remaining object, stopping at the first error. The iterator is closed afterwards
+func (it *ObjectIterator) ForEach(f func(obj any) error) error {
+	err := it.forEach(f)
+	cerr := it.Close()
+	if err != nil {
+		if cerr != nil {
+			return errors.Wrap(cerr, "while handling "+err.Error())
+		}
+		return err
+	}
+	return cerr
+}
+
+// forEach implements ForEach without closing the iterator
+func (it *ObjectIterator) forEach(f func(obj any) error) error {
+	for it.Next() {
+		err := f(it.Object())
+		if err != nil {
+			return err
+		}
+	}
+	return it.Err()
+}
+
+// collect returns all remaining objects in a slice. The iterator is closed afterwards
+func (it *ObjectIterator) collect() ([]any, error) {
+	var result []any
+	err := it.ForEach(func(obj any) error {
+		result = append(result, obj)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
@@ -0,0 +1,110 @@
+package sqlcache
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"strconv"
+	"testing"
+)
+
+func TestObjectIterator(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	store, err := NewIndexer(testStoreObject{}, testStoreKeyFunc, TEST_DB_LOCATION, testStoreIndexers())
+	assert.NoError(err)
+	assert.NoError(store.Add(testStoreObject{Id: "a", Val: "b"}))
+	assert.NoError(store.Add(testStoreObject{Id: "c", Val: "d"}))
+	assert.NoError(store.Add(testStoreObject{Id: "e", Val: "b"}))
+
+	// iterate over everything
+	it, err := store.ListIter(ctx)
+	assert.NoError(err)
+	found := sets.String{}
+	for it.Next() {
+		found.Insert(it.Object().(testStoreObject).Id)
+	}
+	assert.NoError(it.Err())
+	assert.NoError(it.Close())
+	assert.NoError(it.Close())
+	assert.Equal(sets.NewString("a", "c", "e"), found)
+
+	// iterate over an index
+	it, err = store.ByIndexIter(ctx, "by_val", "b")
+	assert.NoError(err)
+	found = sets.String{}
+	err = it.ForEach(func(obj any) error {
+		found.Insert(obj.(testStoreObject).Id)
+		return nil
+	})
+	assert.NoError(err)
+	assert.Equal(sets.NewString("a", "e"), found)
+
+	// errors stop iteration
+	it, err = store.ListIter(ctx)
+	assert.NoError(err)
+	calls := 0
+	err = it.ForEach(func(obj any) error {
+		calls++
+		return errors.New("stop")
+	})
+	assert.EqualError(err, "stop")
+	assert.Equal(1, calls)
+
+	assert.NoError(store.Close())
+}
+
+func TestListByOptionsIter(t *testing.T) {
+	assert := assert.New(t)
+
+	l, err := NewListOptionIndexer(&v1.Pod{}, TEST_DB_LOCATION, fieldFunc)
+	assert.NoError(err)
+	for i, color := range []string{"red", "blue", "black"} {
+		assert.NoError(l.Add(&v1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Name:            color,
+			ResourceVersion: strconv.Itoa(i + 1),
+			Labels:          map[string]string{"Color": color},
+		}}))
+	}
+
+	it, err := l.ListByOptionsIter(context.Background(), ListOptions{Sort: Sort{primaryField: []string{"Color"}}})
+	assert.NoError(err)
+	names := []string{}
+	for it.Next() {
+		names = append(names, it.Object().(*v1.Pod).Name)
+	}
+	assert.NoError(it.Err())
+	assert.NoError(it.Close())
+	assert.Equal([]string{"black", "blue", "red"}, names)
+
+	assert.NoError(l.Close())
+}
+
+func TestListByOptionsIterCancellation(t *testing.T) {
+	assert := assert.New(t)
+
+	l, err := NewListOptionIndexer(&v1.Pod{}, TEST_DB_LOCATION, fieldFunc)
+	assert.NoError(err)
+	for i := 0; i < 10; i++ {
+		assert.NoError(l.Add(&v1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Name:            "pod" + strconv.Itoa(i),
+			ResourceVersion: strconv.Itoa(i + 1),
+		}}))
+	}
+
+	// the client goes away while a list is being streamed
+	ctx, cancel := context.WithCancel(context.Background())
+	it, err := l.ListByOptionsIter(ctx, ListOptions{})
+	assert.NoError(err)
+	assert.True(it.Next())
+	cancel()
+	assert.False(it.Next())
+	assert.ErrorIs(it.Err(), context.Canceled)
+	assert.NoError(it.Close())
+
+	assert.NoError(l.Close())
+}
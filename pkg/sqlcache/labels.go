@@ -0,0 +1,91 @@
+package sqlcache
+
+import (
+	"database/sql"
+	"github.com/pkg/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	"strconv"
+	"strings"
+)
+
+// labelMatchClause matches rows of labels of the object_history row o, for the label name passed as parameter
+const labelMatchClause = "lb.key = o.key AND lb.version = o.version AND lb.label = ?"
+
+// integerLabelClause matches label values that strconv.ParseInt accepts, as required by Gt and Lt requirements
+const integerLabelClause = "(lb.value GLOB '[0-9]*' OR lb.value GLOB '[-+][0-9]*') AND NOT substr(lb.value, 2) GLOB '*[^0-9]*'"
+
+// afterLabelsUpsert saves labels of obj, at version, into the labels table as part of tx
+func (l *ListOptionIndexer) afterLabelsUpsert(key string, version int, obj any, tx *sql.Tx) error {
+	_, err := tx.Stmt(l.deleteLabelsStmt).Exec(key, version)
+	if err != nil {
+		return err
+	}
+	o, ok := obj.(meta.Object)
+	if !ok {
+		return errors.Errorf("Unexpected object does not conform to meta.Object: %v", obj)
+	}
+	for label, value := range o.GetLabels() {
+		_, err = tx.Stmt(l.addLabelStmt).Exec(key, version, label, value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// labelSelectorClauses returns WHERE clauses matching objects selected by selector, with their parameters
+func labelSelectorClauses(selector labels.Selector) ([]string, []any, error) {
+	if selector == nil || selector.Empty() {
+		return nil, nil, nil
+	}
+	requirements, selectable := selector.Requirements()
+	if !selectable {
+		// labels.Nothing()
+		return []string{"0"}, nil, nil
+	}
+
+	clauses := []string{}
+	params := []any{}
+	for _, requirement := range requirements {
+		params = append(params, requirement.Key())
+		values := requirement.Values().List()
+		switch requirement.Operator() {
+		case selection.Equals, selection.DoubleEquals, selection.In, selection.NotEquals, selection.NotIn:
+			placeholders := strings.TrimPrefix(strings.Repeat(", ?", len(values)), ", ")
+			clause := "EXISTS (SELECT 1 FROM labels lb WHERE " + labelMatchClause + " AND lb.value IN (" + placeholders + "))"
+			op := requirement.Operator()
+			if op == selection.NotEquals || op == selection.NotIn {
+				// objects without the label match, as in Kubernetes
+				clause = "NOT " + clause
+			}
+			clauses = append(clauses, clause)
+			for _, value := range values {
+				params = append(params, value)
+			}
+		case selection.Exists:
+			clauses = append(clauses, "EXISTS (SELECT 1 FROM labels lb WHERE "+labelMatchClause+")")
+		case selection.DoesNotExist:
+			clauses = append(clauses, "NOT EXISTS (SELECT 1 FROM labels lb WHERE "+labelMatchClause+")")
+		case selection.GreaterThan, selection.LessThan:
+			if len(values) != 1 {
+				return nil, nil, errors.Errorf("Invalid label selector %q, expected one value", requirement.String())
+			}
+			value, err := strconv.ParseInt(values[0], 10, 64)
+			if err != nil {
+				return nil, nil, errors.Wrapf(err, "Invalid label selector %q", requirement.String())
+			}
+			operator := ">"
+			if requirement.Operator() == selection.LessThan {
+				operator = "<"
+			}
+			clauses = append(clauses, "EXISTS (SELECT 1 FROM labels lb WHERE "+labelMatchClause+" AND "+integerLabelClause+
+				" AND CAST(lb.value AS INTEGER) "+operator+" ?)")
+			params = append(params, value)
+		default:
+			return nil, nil, errors.Errorf("Unsupported label selector operator %q", requirement.Operator())
+		}
+	}
+	return clauses, params, nil
+}
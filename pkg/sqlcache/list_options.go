@@ -0,0 +1,671 @@
+package sqlcache
+
+import (
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// query string parameter names, as in steve
+const (
+	filterParam   = "filter"
+	sortParam     = "sort"
+	pageSizeParam = "pagesize"
+	pageParam     = "page"
+	revisionParam = "revision"
+	limitParam    = "limit"
+	continueParam = "continue"
+	// labelSelectorParam and fieldSelectorParam are as in the Kubernetes API
+	labelSelectorParam = "labelSelector"
+	fieldSelectorParam = "fieldSelector"
+	namespaceParam     = "namespace"
+)
+
+// ErrUnknownField is returned (wrapped) when ListOptions refer to a field without a FieldFunc
+var ErrUnknownField = errors.New("unknown field")
+
+// ListOptions represents the query parameters that may be included in a list request.
+// The zero value lists all objects at the latest revision
+type ListOptions struct {
+	// ChunkSize is the maximum number of objects to return at once, if positive. Chunks are consistent snapshots at
+	// the same revision, ObjectIterator.Continue returns a token to get the next one via Resume. Objects are ordered
+	// by Sort, then by key. See limit in ParseListOptions
+	ChunkSize int
+	// Resume is a token to continue a previous chunked list from, see ChunkSize and continue in ParseListOptions.
+	// Filters and Sort must be the same as in the previous list
+	Resume string
+	// Namespaces restricts results to objects in any of the given namespaces, if not empty. Cluster-scoped objects
+	// have no namespace, so they are only listed if Namespaces is empty
+	Namespaces []string
+	// LabelSelector selects objects by their labels, if not nil
+	LabelSelector labels.Selector
+	// FieldSelector selects objects by their fields, if not nil. As in the Kubernetes API, metadata.name and
+	// metadata.namespace are always supported, other fields must have a FieldFunc, as in Filters
+	FieldSelector fields.Selector
+	// Filters must all match, see NewFilter, NewFilterOp and NewOrFilter
+	Filters []Filter
+	// Sort determines result ordering, see NewSort
+	Sort Sort
+	// Pagination limits results to a page, see NewPagination
+	Pagination Pagination
+	// Revision is the resourceVersion to list objects at, "" for the latest
+	Revision string
+}
+
+// Filter represents a field to filter by.
+// A subfield in an object is represented in a request query using . notation, e.g. 'metadata.name'.
+// The subfield is internally represented as a slice, e.g. [metadata, name].
+// A Filter can also be an OR group of other Filters, see NewOrFilter
+type Filter struct {
+	field []string
+	match string
+	op    FilterOp
+	// matches are the values for FilterIn, FilterNotIn and FilterContainsAll
+	matches []string
+	// or are the alternatives of an OR group, if not nil
+	or []Filter
+}
+
+// FilterOp is the operator a Filter compares field values with.
+// On multi-valued fields (see FieldFunc), operators match if any element matches, while FilterNotEquals,
+// FilterNotIn and FilterNotExists match if no element matches the corresponding positive operator
+type FilterOp int
+
+const (
+	// FilterContains matches values containing match (case-insensitive for ASCII)
+	FilterContains FilterOp = iota
+	// FilterEquals matches values equal to match
+	FilterEquals
+	// FilterNotEquals matches values different from match, or absent
+	FilterNotEquals
+	// FilterPrefix matches values starting with match
+	FilterPrefix
+	// FilterIn matches values equal to any of the matches
+	FilterIn
+	// FilterNotIn matches values different from all of the matches, or absent
+	FilterNotIn
+	// FilterLessThan matches values lower than match. Typed fields are compared according to their FieldType,
+	// StringField values and match must be numbers or RFC 3339 timestamps
+	FilterLessThan
+	// FilterLessThanOrEqual matches values lower than or equal to match, see FilterLessThan
+	FilterLessThanOrEqual
+	// FilterGreaterThan matches values greater than match, see FilterLessThan
+	FilterGreaterThan
+	// FilterGreaterThanOrEqual matches values greater than or equal to match, see FilterLessThan
+	FilterGreaterThanOrEqual
+	// FilterExists matches present values, that is, those for which the FieldFunc did not return nil
+	FilterExists
+	// FilterNotExists matches absent values, that is, those for which the FieldFunc returned nil
+	FilterNotExists
+	// FilterContainsAll matches multi-valued fields having all of the matches among their elements
+	FilterContainsAll
+)
+
+// Sort represents the criteria to sort on.
+// The subfield to sort by is represented in a request query using . notation, e.g. 'metadata.name'.
+// The subfield is internally represented as a slice, e.g. [metadata, name].
+// The order is represented by prefixing the sort key by '-', e.g. sort=-metadata.name.
+type Sort struct {
+	primaryField   []string
+	secondaryField []string
+	primaryOrder   SortOrder
+	secondaryOrder SortOrder
+}
+
+// SortOrder represents whether the list should be ascending or descending.
+type SortOrder int
+
+const (
+	// ASC stands for ascending order.
+	ASC SortOrder = iota
+	// DESC stands for descending (reverse) order.
+	DESC
+)
+
+// Pagination represents how to return paginated results.
+type Pagination struct {
+	pageSize int
+	page     int
+}
+
+// NewFilter returns a Filter matching objects whose field, in . notation, contains match
+func NewFilter(field string, match string) Filter {
+	return NewFilterOp(field, FilterContains, match)
+}
+
+// NewFilterOp returns a Filter matching objects whose field, in . notation, compares to matches according to op.
+// FilterIn, FilterNotIn and FilterContainsAll take any number of matches, FilterExists and FilterNotExists none, other operators one
+func NewFilterOp(field string, op FilterOp, matches ...string) Filter {
+	f := Filter{field: strings.Split(field, "."), op: op, matches: matches}
+	if len(matches) > 0 {
+		f.match = matches[0]
+	}
+	return f
+}
+
+// NewOrFilter returns a Filter matching objects matched by any of filters
+func NewOrFilter(filters ...Filter) Filter {
+	return Filter{or: append([]Filter{}, filters...)}
+}
+
+// Field returns the field to filter by, in . notation, or "" for OR groups
+func (f Filter) Field() string {
+	return strings.Join(f.field, ".")
+}
+
+// Op returns the operator to compare the field with
+func (f Filter) Op() FilterOp {
+	return f.op
+}
+
+// Match returns the string the field is compared with
+func (f Filter) Match() string {
+	return f.match
+}
+
+// Matches returns the strings the field is compared with by FilterIn, FilterNotIn and FilterContainsAll
+func (f Filter) Matches() []string {
+	return f.matches
+}
+
+// OrFilters returns the alternatives of an OR group, or nil if f is not one
+func (f Filter) OrFilters() []Filter {
+	return f.or
+}
+
+// NewSort returns a Sort by field, in . notation, in the given order
+func NewSort(field string, order SortOrder) Sort {
+	return Sort{primaryField: strings.Split(field, "."), primaryOrder: order}
+}
+
+// ThenBy returns a copy of this Sort which also sorts by field, in . notation, in the given order
+// among objects with the same primary field value
+func (s Sort) ThenBy(field string, order SortOrder) Sort {
+	s.secondaryField = strings.Split(field, ".")
+	s.secondaryOrder = order
+	return s
+}
+
+// PrimaryField returns the field to sort by, in . notation, or "" if unsorted
+func (s Sort) PrimaryField() string {
+	return strings.Join(s.primaryField, ".")
+}
+
+// PrimaryOrder returns the order of PrimaryField
+func (s Sort) PrimaryOrder() SortOrder {
+	return s.primaryOrder
+}
+
+// SecondaryField returns the field to sort by among objects with the same PrimaryField value, in . notation,
+// or "" if none
+func (s Sort) SecondaryField() string {
+	return strings.Join(s.secondaryField, ".")
+}
+
+// SecondaryOrder returns the order of SecondaryField
+func (s Sort) SecondaryOrder() SortOrder {
+	return s.secondaryOrder
+}
+
+// NewPagination returns a Pagination returning the page-th page (starting from 1) of pageSize objects
+func NewPagination(pageSize int, page int) Pagination {
+	return Pagination{pageSize: pageSize, page: page}
+}
+
+// PageSize returns the maximum number of objects per page, or 0 if results are not paginated
+func (p Pagination) PageSize() int {
+	return p.pageSize
+}
+
+// Page returns the page number, starting from 1
+func (p Pagination) Page() int {
+	return p.page
+}
+
+// ParseListOptions returns ListOptions from steve-style query string parameters:
+//   - filter=<condition>[,<condition>...], possibly repeated. Comma-separated conditions form an OR group,
+//     see NewOrFilter. Conditions are:
+//     <field>=<match> (contains), <field>==<match>, <field>!=<match>, <field>^=<match> (prefix),
+//     <field><<match>, <field><=<match>, <field>><match>, <field>>=<match>,
+//     <field> in (<match>,...), <field> notin (<match>,...), <field> all (<match>,...) (contains all),
+//     <field> (exists) and !<field> (does not exist),
+//     see NewFilter and NewFilterOp. In matches, commas and parentheses must be escaped with a \, as must \ before
+//     them or another \. Other backslashes are read literally
+//   - sort=<field>[,<field>], fields prefixed by - are sorted in descending order, see NewSort
+//   - pagesize=<n> and page=<n>, see NewPagination
+//   - revision=<resourceVersion>
+//   - limit=<n> and continue=<token>, see ChunkSize and Resume
+//   - namespace=<namespace>[,<namespace>...], see Namespaces
+//   - labelSelector=<selector> and fieldSelector=<selector>, see LabelSelector and FieldSelector
+//
+// Fields are not checked against FieldFuncs, see ListOptionIndexer.Validate
+func ParseListOptions(q url.Values) (ListOptions, error) {
+	lo := ListOptions{}
+
+	for _, param := range q[filterParam] {
+		filter, err := parseFilter(param)
+		if err != nil {
+			return ListOptions{}, err
+		}
+		lo.Filters = append(lo.Filters, filter)
+	}
+
+	if sortKeys := q.Get(sortParam); sortKeys != "" {
+		sortParts := strings.Split(sortKeys, ",")
+		if len(sortParts) > 2 {
+			return ListOptions{}, errors.Errorf("Invalid sort %q, at most two fields are supported", sortKeys)
+		}
+		for i, part := range sortParts {
+			order := ASC
+			field := part
+			if strings.HasPrefix(field, "-") {
+				order = DESC
+				field = field[1:]
+			}
+			if field == "" {
+				return ListOptions{}, errors.Errorf("Invalid sort %q, empty field", sortKeys)
+			}
+			if i == 0 {
+				lo.Sort = NewSort(field, order)
+			} else {
+				lo.Sort = lo.Sort.ThenBy(field, order)
+			}
+		}
+	}
+
+	pageSize, err := parseNonNegative(q, pageSizeParam)
+	if err != nil {
+		return ListOptions{}, err
+	}
+	page, err := parseNonNegative(q, pageParam)
+	if err != nil {
+		return ListOptions{}, err
+	}
+	lo.Pagination = NewPagination(pageSize, page)
+
+	lo.Revision = q.Get(revisionParam)
+	if lo.Revision != "" {
+		if _, err := strconv.Atoi(lo.Revision); err != nil {
+			return ListOptions{}, errors.Errorf("Invalid %s %q, expected an integer", revisionParam, lo.Revision)
+		}
+	}
+
+	lo.ChunkSize, err = parseNonNegative(q, limitParam)
+	if err != nil {
+		return ListOptions{}, err
+	}
+	lo.Resume = q.Get(continueParam)
+
+	if namespaces := q.Get(namespaceParam); namespaces != "" {
+		lo.Namespaces = strings.Split(namespaces, ",")
+	}
+
+	if selector := q.Get(labelSelectorParam); selector != "" {
+		lo.LabelSelector, err = labels.Parse(selector)
+		if err != nil {
+			return ListOptions{}, errors.Wrapf(err, "Invalid %s %q", labelSelectorParam, selector)
+		}
+	}
+	if selector := q.Get(fieldSelectorParam); selector != "" {
+		lo.FieldSelector, err = fields.ParseSelector(selector)
+		if err != nil {
+			return ListOptions{}, errors.Wrapf(err, "Invalid %s %q", fieldSelectorParam, selector)
+		}
+	}
+
+	return lo, nil
+}
+
+// filterOpSymbols maps binary FilterOps to their query string symbols
+var filterOpSymbols = map[FilterOp]string{
+	FilterContains:           "=",
+	FilterEquals:             "==",
+	FilterNotEquals:          "!=",
+	FilterPrefix:             "^=",
+	FilterLessThan:           "<",
+	FilterLessThanOrEqual:    "<=",
+	FilterGreaterThan:        ">",
+	FilterGreaterThanOrEqual: ">=",
+}
+
+var (
+	// binaryConditionRegexp matches <field><symbol><match>, preferring two-character symbols
+	binaryConditionRegexp = regexp.MustCompile(`^([^=!<>^\s(),]+)(==|!=|\^=|<=|>=|=|<|>)(.*)$`)
+	// setConditionRegexp matches <field> in (<match>,...), <field> notin (<match>,...) and <field> all (<match>,...)
+	setConditionRegexp = regexp.MustCompile(`^([^=!<>^\s(),]+)\s+(in|notin|all)\s*\((.*)\)$`)
+	// existsConditionRegexp matches <field> and !<field>
+	existsConditionRegexp = regexp.MustCompile(`^(!?)([^=!<>^\s(),]+)$`)
+)
+
+// parseFilter returns the Filter represented by a filter query string parameter, see ParseListOptions
+func parseFilter(param string) (Filter, error) {
+	conditions := splitOutsideParentheses(param)
+	filters := []Filter{}
+	for _, condition := range conditions {
+		filter, err := parseCondition(condition)
+		if err != nil {
+			return Filter{}, errors.Wrapf(err, "Invalid filter %q", param)
+		}
+		filters = append(filters, filter)
+	}
+	if len(filters) == 1 {
+		return filters[0], nil
+	}
+	return NewOrFilter(filters...), nil
+}
+
+// parseCondition returns the Filter represented by a single condition, see ParseListOptions
+func parseCondition(condition string) (Filter, error) {
+	if m := setConditionRegexp.FindStringSubmatch(condition); m != nil {
+		op := map[string]FilterOp{"in": FilterIn, "notin": FilterNotIn, "all": FilterContainsAll}[m[2]]
+		var matches []string
+		if m[3] != "" {
+			for _, escaped := range splitOutsideParentheses(m[3]) {
+				matches = append(matches, unescapeMatch(escaped))
+			}
+		}
+		return NewFilterOp(m[1], op, matches...), nil
+	}
+	if m := binaryConditionRegexp.FindStringSubmatch(condition); m != nil {
+		for op, symbol := range filterOpSymbols {
+			if symbol == m[2] {
+				return NewFilterOp(m[1], op, unescapeMatch(m[3])), nil
+			}
+		}
+	}
+	if m := existsConditionRegexp.FindStringSubmatch(condition); m != nil {
+		if m[1] == "!" {
+			return NewFilterOp(m[2], FilterNotExists), nil
+		}
+		return NewFilterOp(m[2], FilterExists), nil
+	}
+	return Filter{}, errors.Errorf("could not parse condition %q", condition)
+}
+
+// splitOutsideParentheses splits s at commas not enclosed in parentheses, ignoring escaped characters
+func splitOutsideParentheses(s string) []string {
+	result := []string{}
+	depth := 0
+	start := 0
+	escaped := false
+	for i, c := range s {
+		if escaped {
+			escaped = false
+			continue
+		}
+		switch c {
+		case '\\':
+			escaped = true
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				result = append(result, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(result, s[start:])
+}
+
+// matchEscaper escapes characters with a special meaning in filter matches, see ParseListOptions
+var matchEscaper = strings.NewReplacer(`\`, `\\`, `,`, `\,`, `(`, `\(`, `)`, `\)`)
+
+// unescapeMatch reverses matchEscaper. Backslashes not followed by a character it escapes are kept, so that values
+// such as Windows paths can also be written unescaped, as in steve
+func unescapeMatch(s string) string {
+	var result strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && strings.IndexByte(`\,()`, s[i+1]) >= 0 {
+			i++
+		}
+		result.WriteByte(s[i])
+	}
+	return result.String()
+}
+
+// escapeMatches returns matches escaped and separated by commas
+func escapeMatches(matches []string) string {
+	escaped := []string{}
+	for _, match := range matches {
+		escaped = append(escaped, matchEscaper.Replace(match))
+	}
+	return strings.Join(escaped, ",")
+}
+
+// String returns f in the query string syntax, see ParseListOptions
+func (f Filter) String() string {
+	if f.or != nil {
+		conditions := []string{}
+		for _, alternative := range f.or {
+			conditions = append(conditions, alternative.String())
+		}
+		return strings.Join(conditions, ",")
+	}
+
+	switch f.op {
+	case FilterIn:
+		return f.Field() + " in (" + escapeMatches(f.matches) + ")"
+	case FilterNotIn:
+		return f.Field() + " notin (" + escapeMatches(f.matches) + ")"
+	case FilterContainsAll:
+		return f.Field() + " all (" + escapeMatches(f.matches) + ")"
+	case FilterExists:
+		return f.Field()
+	case FilterNotExists:
+		return "!" + f.Field()
+	}
+	return f.Field() + filterOpSymbols[f.op] + matchEscaper.Replace(f.match)
+}
+
+// parseNonNegative returns the non-negative integer value of param in q, or 0 if absent
+func parseNonNegative(q url.Values, param string) (int, error) {
+	value := q.Get(param)
+	if value == "" {
+		return 0, nil
+	}
+	result, err := strconv.Atoi(value)
+	if err != nil || result < 0 {
+		return 0, errors.Errorf("Invalid %s %q, expected a non-negative integer", param, value)
+	}
+	return result, nil
+}
+
+// Values returns query string parameters representing lo, inverse of ParseListOptions.
+// Useful to generate links to other pages, eg. after changing Pagination or Resume
+func (lo ListOptions) Values() url.Values {
+	q := url.Values{}
+	for _, filter := range lo.Filters {
+		q.Add(filterParam, filter.String())
+	}
+
+	if len(lo.Sort.primaryField) > 0 {
+		sortKeys := sortKey(lo.Sort.primaryField, lo.Sort.primaryOrder)
+		if len(lo.Sort.secondaryField) > 0 {
+			sortKeys += "," + sortKey(lo.Sort.secondaryField, lo.Sort.secondaryOrder)
+		}
+		q.Set(sortParam, sortKeys)
+	}
+
+	if lo.Pagination.pageSize > 0 {
+		q.Set(pageSizeParam, strconv.Itoa(lo.Pagination.pageSize))
+	}
+	if lo.Pagination.page > 0 {
+		q.Set(pageParam, strconv.Itoa(lo.Pagination.page))
+	}
+	if lo.Revision != "" {
+		q.Set(revisionParam, lo.Revision)
+	}
+	if lo.ChunkSize > 0 {
+		q.Set(limitParam, strconv.Itoa(lo.ChunkSize))
+	}
+	if lo.Resume != "" {
+		q.Set(continueParam, lo.Resume)
+	}
+	if len(lo.Namespaces) > 0 {
+		q.Set(namespaceParam, strings.Join(lo.Namespaces, ","))
+	}
+	if lo.LabelSelector != nil && !lo.LabelSelector.Empty() {
+		q.Set(labelSelectorParam, lo.LabelSelector.String())
+	}
+	if lo.FieldSelector != nil && !lo.FieldSelector.Empty() {
+		q.Set(fieldSelectorParam, lo.FieldSelector.String())
+	}
+	return q
+}
+
+// Encode returns lo as a URL-encoded query string, see Values
+func (lo ListOptions) Encode() string {
+	return lo.Values().Encode()
+}
+
+// sortKey returns the sort parameter representation of field in order
+func sortKey(field []string, order SortOrder) string {
+	if order == DESC {
+		return "-" + strings.Join(field, ".")
+	}
+	return strings.Join(field, ".")
+}
+
+// Validate returns an error if lo refers to fields without a FieldFunc (wrapping ErrUnknownField), has filters
+// or field selectors with values not comparable with field values, has empty namespaces, or has invalid pagination
+// or chunking
+func (l *ListOptionIndexer) Validate(lo ListOptions) error {
+	names := l.fieldNames()
+	for _, field := range lo.fields() {
+		i := sort.SearchStrings(names, toColumnName(field))
+		if i == len(names) || names[i] != toColumnName(field) {
+			return errors.Wrapf(ErrUnknownField, "%q, valid fields are: %s", strings.Join(field, "."), strings.Join(names, ", "))
+		}
+	}
+	for _, filter := range lo.Filters {
+		err := filter.validate()
+		if err != nil {
+			return err
+		}
+		// matches must be comparable with field values
+		_, _, err = l.filterClause(filter)
+		if err != nil {
+			return errors.Wrapf(err, "Invalid filter %q", filter.String())
+		}
+	}
+	if lo.Pagination.pageSize < 0 || lo.Pagination.page < 0 {
+		return errors.Errorf("Invalid pagination: page size %d, page %d", lo.Pagination.pageSize, lo.Pagination.page)
+	}
+	for _, namespace := range lo.Namespaces {
+		if namespace == "" {
+			return errors.New("Invalid empty namespace, leave Namespaces empty to list objects in all namespaces")
+		}
+	}
+	_, _, err := labelSelectorClauses(lo.LabelSelector)
+	if err != nil {
+		return err
+	}
+	_, _, err = l.fieldSelectorClauses(lo.FieldSelector)
+	if err != nil {
+		return err
+	}
+	if lo.ChunkSize < 0 {
+		return errors.Errorf("Invalid chunk size %d", lo.ChunkSize)
+	}
+	if (lo.ChunkSize > 0 || lo.Resume != "") && lo.Pagination.pageSize > 0 {
+		return errors.New("ChunkSize and Resume cannot be combined with Pagination")
+	}
+	return nil
+}
+
+// validate returns an error if f has the wrong number of matches for its operator
+func (f Filter) validate() error {
+	if f.or != nil {
+		if len(f.or) == 0 {
+			return errors.New("Invalid empty OR filter group")
+		}
+		for _, alternative := range f.or {
+			err := alternative.validate()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	switch f.op {
+	case FilterIn, FilterNotIn, FilterContainsAll:
+		return nil
+	case FilterExists, FilterNotExists:
+		if len(f.matches) > 0 {
+			return errors.Errorf("Invalid filter on %s, unexpected values: %v", f.Field(), f.matches)
+		}
+		return nil
+	case FilterContains, FilterEquals, FilterNotEquals, FilterPrefix,
+		FilterLessThan, FilterLessThanOrEqual, FilterGreaterThan, FilterGreaterThanOrEqual:
+	default:
+		return errors.Errorf("Invalid filter on %s, unknown operator %d", f.Field(), f.op)
+	}
+	if len(f.matches) > 1 {
+		return errors.Errorf("Invalid filter on %s, expected one value, got: %v", f.Field(), f.matches)
+	}
+	return nil
+}
+
+// rangeOperand returns match as a float64 if it is a number, or as a string if it is an RFC 3339 timestamp
+func rangeOperand(match string) (any, error) {
+	if number, err := strconv.ParseFloat(match, 64); err == nil {
+		return number, nil
+	}
+	if _, err := time.Parse(time.RFC3339Nano, match); err == nil {
+		return match, nil
+	}
+	return nil, errors.Errorf("%q is neither a number nor an RFC 3339 timestamp", match)
+}
+
+// fields returns all distinct fields lo filters or sorts by
+func (lo ListOptions) fields() [][]string {
+	all := [][]string{}
+	var addFilterFields func(filters []Filter)
+	addFilterFields = func(filters []Filter) {
+		for _, filter := range filters {
+			if filter.or != nil {
+				addFilterFields(filter.or)
+			} else {
+				all = append(all, filter.field)
+			}
+		}
+	}
+	addFilterFields(lo.Filters)
+	all = append(all, fieldSelectorFields(lo.FieldSelector)...)
+	if len(lo.Sort.primaryField) > 0 {
+		all = append(all, lo.Sort.primaryField)
+	}
+	if len(lo.Sort.secondaryField) > 0 {
+		all = append(all, lo.Sort.secondaryField)
+	}
+
+	result := [][]string{}
+	seen := map[string]bool{}
+	for _, field := range all {
+		if !seen[toColumnName(field)] {
+			seen[toColumnName(field)] = true
+			result = append(result, field)
+		}
+	}
+	return result
+}
+
+// fieldNames returns the sorted, sanitized names of all fields with a FieldFunc
+func (l *ListOptionIndexer) fieldNames() []string {
+	result := []string{}
+	for name := range l.fieldFuncs {
+		result = append(result, sanitize(name))
+	}
+	sort.Strings(result)
+	return result
+}
@@ -0,0 +1,188 @@
+package sqlcache
+
+import (
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net/url"
+	"testing"
+)
+
+func TestListOptionsBuilders(t *testing.T) {
+	assert := assert.New(t)
+
+	f := NewFilter("metadata.name", "foo")
+	assert.Equal("metadata.name", f.Field())
+	assert.Equal("foo", f.Match())
+
+	s := NewSort("Color", DESC).ThenBy("metadata.name", ASC)
+	assert.Equal("Color", s.PrimaryField())
+	assert.Equal(DESC, s.PrimaryOrder())
+	assert.Equal("metadata.name", s.SecondaryField())
+	assert.Equal(ASC, s.SecondaryOrder())
+	assert.Equal("", Sort{}.PrimaryField())
+
+	p := NewPagination(10, 2)
+	assert.Equal(10, p.PageSize())
+	assert.Equal(2, p.Page())
+}
+
+func TestListOptionsValidation(t *testing.T) {
+	assert := assert.New(t)
+
+	l, err := NewListOptionIndexer(&v1.Pod{}, TEST_DB_LOCATION, fieldFunc)
+	assert.NoError(err)
+	for i, color := range []string{"red", "blue", "red"} {
+		assert.NoError(l.Add(&v1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Name:            color + string(rune('a'+i)),
+			ResourceVersion: string(rune('1' + i)),
+			Labels:          map[string]string{"Brand": "ferrari", "Color": color},
+		}}))
+	}
+
+	// filtering and sorting by the same field
+	r, err := l.ListByOptions(ListOptions{
+		Filters:    []Filter{NewFilter("Color", "red")},
+		Sort:       NewSort("Color", ASC).ThenBy("Brand", DESC),
+		Pagination: NewPagination(1, 2),
+	})
+	assert.NoError(err)
+	assert.Len(r, 1)
+	assert.Equal("redc", r[0].(*v1.Pod).Name)
+
+	// unknown fields are rejected
+	for _, lo := range []ListOptions{
+		{Filters: []Filter{NewFilter("Model", "f40")}},
+		{Sort: NewSort("Model", ASC)},
+		{Sort: NewSort("Color", ASC).ThenBy("Model", ASC)},
+	} {
+		assert.NoError(l.Validate(ListOptions{Filters: []Filter{NewFilter("Color", "red")}}))
+		err = l.Validate(lo)
+		assert.True(errors.Is(err, ErrUnknownField))
+		_, err = l.ListByOptions(lo)
+		assert.True(errors.Is(err, ErrUnknownField))
+	}
+	assert.Error(l.Validate(ListOptions{Pagination: NewPagination(-1, 0)}))
+
+	assert.NoError(l.Close())
+}
+
+func TestParseListOptions(t *testing.T) {
+	assert := assert.New(t)
+
+	q, err := url.ParseQuery("filter=metadata.name=foo&filter=Color=red=ish&sort=-metadata.creationTimestamp,metadata.name&pagesize=10&page=2&revision=5&limit=100&continue=abc")
+	assert.NoError(err)
+	lo, err := ParseListOptions(q)
+	assert.NoError(err)
+	assert.Equal(ListOptions{
+		ChunkSize:  100,
+		Resume:     "abc",
+		Filters:    []Filter{NewFilter("metadata.name", "foo"), NewFilter("Color", "red=ish")},
+		Sort:       NewSort("metadata.creationTimestamp", DESC).ThenBy("metadata.name", ASC),
+		Pagination: NewPagination(10, 2),
+		Revision:   "5",
+	}, lo)
+
+	// round trip
+	q2, err := url.ParseQuery(lo.Encode())
+	assert.NoError(err)
+	assert.Equal(q, q2)
+	lo2, err := ParseListOptions(lo.Values())
+	assert.NoError(err)
+	assert.Equal(lo, lo2)
+
+	// empty
+	lo, err = ParseListOptions(url.Values{})
+	assert.NoError(err)
+	assert.Equal(ListOptions{}, lo)
+	assert.Equal("", lo.Encode())
+
+	// filter operators
+	q = url.Values{filterParam: []string{
+		"a==1",
+		"b!=2",
+		"c^=x",
+		"d<1",
+		"e<=2",
+		"f>3",
+		"g>=2023-01-01T00:00:00Z",
+		"h in (x,y)",
+		"i notin ()",
+		"j",
+		"!k",
+		"l=x,m==y,n in (z,w)",
+		"o all (x,y)",
+	}}
+	lo, err = ParseListOptions(q)
+	assert.NoError(err)
+	assert.Equal([]Filter{
+		NewFilterOp("a", FilterEquals, "1"),
+		NewFilterOp("b", FilterNotEquals, "2"),
+		NewFilterOp("c", FilterPrefix, "x"),
+		NewFilterOp("d", FilterLessThan, "1"),
+		NewFilterOp("e", FilterLessThanOrEqual, "2"),
+		NewFilterOp("f", FilterGreaterThan, "3"),
+		NewFilterOp("g", FilterGreaterThanOrEqual, "2023-01-01T00:00:00Z"),
+		NewFilterOp("h", FilterIn, "x", "y"),
+		NewFilterOp("i", FilterNotIn),
+		NewFilterOp("j", FilterExists),
+		NewFilterOp("k", FilterNotExists),
+		NewOrFilter(NewFilter("l", "x"), NewFilterOp("m", FilterEquals, "y"), NewFilterOp("n", FilterIn, "z", "w")),
+		NewFilterOp("o", FilterContainsAll, "x", "y"),
+	}, lo.Filters)
+	assert.Equal(q, lo.Values())
+
+	// commas, parentheses and backslashes in matches are escaped
+	lo = ListOptions{Filters: []Filter{
+		NewFilterOp("metadata.name", FilterEquals, "a,b"),
+		NewFilterOp("metadata.name", FilterIn, "x)", "(y,z)", `w\`),
+		NewOrFilter(NewFilter("a", `,\`), NewFilterOp("b", FilterNotIn, ")")),
+	}}
+	assert.Equal([]string{`metadata.name==a\,b`, `metadata.name in (x\),\(y\,z\),w\\)`, `a=\,\\,b notin (\))`}, lo.Values()[filterParam])
+	lo2, err = ParseListOptions(lo.Values())
+	assert.NoError(err)
+	assert.Equal(lo, lo2)
+	q2, err = url.ParseQuery(lo.Encode())
+	assert.NoError(err)
+	lo2, err = ParseListOptions(q2)
+	assert.NoError(err)
+	assert.Equal(lo, lo2)
+
+	// other backslashes are read literally, as in steve
+	for query, expected := range map[string]Filter{
+		`filter=path==C:\Users\foo`:      NewFilterOp("path", FilterEquals, `C:\Users\foo`),
+		`filter=path==C:\\Users\\foo`:    NewFilterOp("path", FilterEquals, `C:\Users\foo`),
+		`filter=a==x\`:                   NewFilterOp("a", FilterEquals, `x\`),
+		`filter=a in (x\)`:               NewFilterOp("a", FilterIn, `x\`),
+		`filter=a in (C:\Users\foo,x\y)`: NewFilterOp("a", FilterIn, `C:\Users\foo`, `x\y`),
+	} {
+		q, err = url.ParseQuery(query)
+		assert.NoError(err)
+		lo, err = ParseListOptions(q)
+		assert.NoError(err, query)
+		assert.Equal([]Filter{expected}, lo.Filters, query)
+		lo2, err = ParseListOptions(lo.Values())
+		assert.NoError(err)
+		assert.Equal(lo, lo2)
+	}
+
+	// errors
+	for _, query := range []string{
+		"filter=",
+		"filter==foo",
+		"filter=a=1,",
+		"filter=a in (x",
+		"sort=a,b,c",
+		"sort=-",
+		"pagesize=ten",
+		"page=-1",
+		"revision=latest",
+		"limit=-5",
+	} {
+		q, err = url.ParseQuery(query)
+		assert.NoError(err)
+		_, err = ParseListOptions(q)
+		assert.Error(err, query)
+	}
+}
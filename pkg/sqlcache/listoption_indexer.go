@@ -1,6 +1,7 @@
 package sqlcache
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	_ "github.com/mattn/go-sqlite3"
@@ -11,78 +12,47 @@ import (
 	"strings"
 )
 
-// ListOptions represents the query parameters that may be included in a list request.
-type ListOptions struct {
-	ChunkSize  int
-	Resume     string
-	Filters    []Filter
-	Sort       Sort
-	Pagination Pagination
-	Revision   string
-}
-
-// Filter represents a field to filter by.
-// A subfield in an object is represented in a request query using . notation, e.g. 'metadata.name'.
-// The subfield is internally represented as a slice, e.g. [metadata, name].
-type Filter struct {
-	field []string
-	match string
-}
-
-// Sort represents the criteria to sort on.
-// The subfield to sort by is represented in a request query using . notation, e.g. 'metadata.name'.
-// The subfield is internally represented as a slice, e.g. [metadata, name].
-// The order is represented by prefixing the sort key by '-', e.g. sort=-metadata.name.
-type Sort struct {
-	primaryField   []string
-	secondaryField []string
-	primaryOrder   SortOrder
-	secondaryOrder SortOrder
-}
-
-// SortOrder represents whether the list should be ascending or descending.
-type SortOrder int
-
-const (
-	// ASC stands for ascending order.
-	ASC SortOrder = iota
-	// DESC stands for descending (reverse) order.
-	DESC
-)
-
-// Pagination represents how to return paginated results.
-type Pagination struct {
-	pageSize int
-	page     int
-}
+// resourceVersionMetadata is the name of the metadata entry holding the last synced resourceVersion
+const resourceVersionMetadata = "resource_version"
 
 // ListOptionIndexer extends VersionedIndexer by allowing queries based on ListOption
 type ListOptionIndexer struct {
 	*VersionedIndexer
 
 	fieldFuncs map[string]FieldFunc
-	addField   *sql.Stmt
+	// fieldTypes maps sanitized field names to their declared types
+	fieldTypes                map[string]FieldType
+	addField                  *sql.Stmt
+	deleteFieldsStmt          *sql.Stmt
+	currentRevisionStmt       *sql.Stmt
+	addLabelStmt              *sql.Stmt
+	deleteLabelsStmt          *sql.Stmt
+	upsertObjectMetaStmt      *sql.Stmt
+	updateResourceVersionStmt *sql.Stmt
 }
 
-// FieldFunc is a function from an object to a filterable/sortable property. Result can be string, int or bool
+// FieldFunc is a function from an object to a filterable/sortable property. Result can be string, int or bool,
+// []string for multi-valued properties, or nil if the object does not have the property. Other types can be returned by fields declared via WithFieldTypes
 type FieldFunc func(obj any) any
 
-// NewListOptionIndexer returns a cache.Indexer on a Kubernetes resource that is also able to satisfy ListOption queries
-func NewListOptionIndexer(example meta.Object, path string, fieldFuncs map[string]FieldFunc) (*ListOptionIndexer, error) {
-	keyFunc := func(a any) (string, error) {
-		o, ok := a.(meta.Object)
-		if !ok {
-			return "", errors.Errorf("Unexpected object does not conform to meta.Object: %v", a)
-		}
-		return o.GetName(), nil
-	}
-
-	return NewCustomListOptionIndexer(example, keyFunc, path, fieldFuncs, cache.Indexers{})
+// NewListOptionIndexer returns a cache.Indexer on a Kubernetes resource that is also able to satisfy ListOption queries.
+// Keys are <namespace>/<name> for namespaced resources and <name> for cluster-scoped ones, as in client-go
+func NewListOptionIndexer(example meta.Object, path string, fieldFuncs map[string]FieldFunc, opts ...Option) (*ListOptionIndexer, error) {
+	return NewCustomListOptionIndexer(example, cache.DeletionHandlingMetaNamespaceKeyFunc, path, fieldFuncs, cache.Indexers{}, opts...)
 }
 
 // NewCustomListOptionIndexer returns a cache.Indexer on a Kubernetes resource that is also able to satisfy ListOption queries
 // with custom keyFunc and Indexers
-func NewCustomListOptionIndexer(example meta.Object, keyFunc cache.KeyFunc, path string, fieldFuncs map[string]FieldFunc, indexers cache.Indexers) (*ListOptionIndexer, error) {
+func NewCustomListOptionIndexer(example meta.Object, keyFunc cache.KeyFunc, path string, fieldFuncs map[string]FieldFunc, indexers cache.Indexers, opts ...Option) (*ListOptionIndexer, error) {
+	// sanity checks first
+	fieldTypes := map[string]FieldType{}
+	for name, fieldType := range buildOptions(opts).fieldTypes {
+		if _, ok := fieldFuncs[name]; !ok {
+			return nil, errors.Wrapf(ErrUnknownField, "%q has a declared type but no FieldFunc", name)
+		}
+		fieldTypes[sanitize(name)] = fieldType
+	}
+
 	versionFunc := func(a any) (int, error) {
 		o, ok := a.(meta.Object)
 		if !ok {
@@ -94,7 +64,16 @@ func NewCustomListOptionIndexer(example meta.Object, keyFunc cache.KeyFunc, path
 		}
 		return i, nil
 	}
-	v, err := NewVersionedIndexer(example, keyFunc, versionFunc, path, indexers)
+	v, err := NewVersionedIndexer(example, keyFunc, versionFunc, path, indexers, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	fieldNames := []string{}
+	for name := range fieldFuncs {
+		fieldNames = append(fieldNames, sanitize(name)+":"+fieldTypes[sanitize(name)].String())
+	}
+	err = v.InitFingerprint("fields", namesFingerprint(fieldNames))
 	if err != nil {
 		return nil, err
 	}
@@ -102,55 +81,133 @@ func NewCustomListOptionIndexer(example meta.Object, keyFunc cache.KeyFunc, path
 	l := &ListOptionIndexer{
 		VersionedIndexer: v,
 		fieldFuncs:       fieldFuncs,
+		fieldTypes:       fieldTypes,
 	}
 	l.RegisterAfterUpsert(l.AfterUpsert)
+	l.RegisterAfterReplace(l.AfterReplace)
 
-	err = l.InitExec(`CREATE TABLE fields (
+	err = l.InitExec(`CREATE TABLE IF NOT EXISTS fields (
     		name VARCHAR NOT NULL,
 			key VARCHAR NOT NULL,
 			version INTEGER NOT NULL,
-            value VARCHAR,
-			PRIMARY KEY (name, key, version),
+			idx INTEGER NOT NULL,
+            value,
+			PRIMARY KEY (name, key, version, idx),
             FOREIGN KEY (key, version) REFERENCES object_history (key, version) ON DELETE CASCADE 
 	   )`)
 	if err != nil {
 		return nil, err
 	}
-	err = l.InitExec(`CREATE INDEX fields_value ON fields(value)`)
+	err = l.InitExec(`CREATE INDEX IF NOT EXISTS fields_value ON fields(value)`)
+	if err != nil {
+		return nil, err
+	}
+	err = l.InitExec(`CREATE TABLE IF NOT EXISTS labels (
+			key VARCHAR NOT NULL,
+			version INTEGER NOT NULL,
+			label VARCHAR NOT NULL,
+			value VARCHAR NOT NULL,
+			PRIMARY KEY (key, version, label),
+			FOREIGN KEY (key, version) REFERENCES object_history (key, version) ON DELETE CASCADE
+	   )`)
+	if err != nil {
+		return nil, err
+	}
+	err = l.InitExec(`CREATE INDEX IF NOT EXISTS labels_label_value ON labels(label, value)`)
+	if err != nil {
+		return nil, err
+	}
+	err = l.InitExec(`CREATE TABLE IF NOT EXISTS object_meta (
+			key VARCHAR NOT NULL,
+			version INTEGER NOT NULL,
+			namespace VARCHAR NOT NULL,
+			name VARCHAR NOT NULL,
+			PRIMARY KEY (key, version),
+			FOREIGN KEY (key, version) REFERENCES object_history (key, version) ON DELETE CASCADE
+	   )`)
+	if err != nil {
+		return nil, err
+	}
+	err = l.InitExec(`CREATE INDEX IF NOT EXISTS object_meta_namespace ON object_meta(namespace)`)
+	if err != nil {
+		return nil, err
+	}
+	err = l.InitExec(`CREATE INDEX IF NOT EXISTS object_meta_name ON object_meta(name)`)
 	if err != nil {
 		return nil, err
 	}
 
-	l.addField = l.Prepare(`INSERT INTO fields(name, key, version, value) VALUES (?,?,?,?) ON CONFLICT DO UPDATE SET value = excluded.value`)
+	p := &statementPreparer{store: l.Store}
+	l.addField = p.prepare(`INSERT INTO fields(name, key, version, idx, value) VALUES (?,?,?,?,?)`)
+	l.deleteFieldsStmt = p.prepare(`DELETE FROM fields WHERE key = ? AND version = ?`)
+	l.addLabelStmt = p.prepare(`INSERT INTO labels(key, version, label, value) VALUES (?, ?, ?, ?)`)
+	l.deleteLabelsStmt = p.prepare(`DELETE FROM labels WHERE key = ? AND version = ?`)
+	l.upsertObjectMetaStmt = p.prepare(`INSERT INTO object_meta(key, version, namespace, name) VALUES (?, ?, ?, ?)
+		ON CONFLICT DO UPDATE SET namespace = excluded.namespace, name = excluded.name`)
+	l.currentRevisionStmt = p.prepareRead(`SELECT MAX(COALESCE(MAX(version), 0), COALESCE(MAX(deleted_version), 0)) FROM object_history`)
+	l.updateResourceVersionStmt = p.prepare(`INSERT INTO metadata(name, value) VALUES ('` + resourceVersionMetadata + `', ?)
+		ON CONFLICT DO UPDATE SET value = excluded.value
+			WHERE CAST(excluded.value AS INTEGER) > CAST(metadata.value AS INTEGER)`)
+	if p.err != nil {
+		return nil, p.err
+	}
 
 	return l, nil
 }
 
 /* Core methods */
 
-// AfterUpsert saves sortable/filterable fields into tables
+// AfterUpsert saves sortable/filterable fields and labels into tables
 func (l *ListOptionIndexer) AfterUpsert(key string, obj any, tx *sql.Tx) error {
 	version, err := l.versionFunc(obj)
 	if err != nil {
 		return err
 	}
 
+	// the same version might be upserted again, eg. on relist
+	_, err = tx.Stmt(l.deleteFieldsStmt).Exec(key, version)
+	if err != nil {
+		return err
+	}
+
 	for name, fieldFunc := range l.fieldFuncs {
-		value := fieldFunc(obj)
-		switch typedValue := value.(type) {
-		case int, bool, string:
-			_, err = tx.Stmt(l.addField).Exec(sanitize(name), key, version, fmt.Sprint(typedValue))
-		case []string:
-			_, err = tx.Stmt(l.addField).Exec(sanitize(name), key, version, strings.Join(typedValue, "|"))
-		default:
-			panic(errors.Errorf("FieldFunc returned a non-supported type value: %v", value))
-		}
+		values, err := l.fieldTypes[sanitize(name)].toSQLValues(fieldFunc(obj))
 		if err != nil {
-			return err
+			return errors.Wrapf(err, "Error in field %s", name)
+		}
+		for i, value := range values {
+			_, err = tx.Stmt(l.addField).Exec(sanitize(name), key, version, i, value)
+			if err != nil {
+				return err
+			}
 		}
 	}
 
-	return nil
+	err = l.afterLabelsUpsert(key, version, obj, tx)
+	if err != nil {
+		return err
+	}
+	err = l.afterObjectMetaUpsert(key, version, obj, tx)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Stmt(l.updateResourceVersionStmt).Exec(strconv.Itoa(version))
+	return err
+}
+
+// AfterReplace records the resourceVersion the whole Store contents were replaced at
+func (l *ListOptionIndexer) AfterReplace(resourceVersion string, tx *sql.Tx) error {
+	if resourceVersion == "" {
+		return nil
+	}
+	return l.SetMetadata(resourceVersionMetadata, resourceVersion, tx)
+}
+
+// LastResourceVersion returns the last resourceVersion this ListOptionIndexer was synced to, either via Replace or
+// any upsert, or "" if it was never synced. Useful to resume watching after a restart, see NewResumingListerWatcher
+func (l *ListOptionIndexer) LastResourceVersion() (string, error) {
+	return l.GetMetadata(resourceVersionMetadata)
 }
 
 func sanitize(name string) string {
@@ -159,33 +216,217 @@ func sanitize(name string) string {
 
 // ListByOptions returns objects according to the ListOptions struct
 func (l *ListOptionIndexer) ListByOptions(lo ListOptions) ([]any, error) {
-	// compute list of interesting fields (filtered or sorted)
-	fields := [][]string{}
-	for _, filter := range lo.Filters {
-		fields = append(fields, filter.field)
+	return l.ListByOptionsContext(context.Background(), lo)
+}
+
+// ListByOptionsContext is like ListByOptions, but stops querying when ctx is done
+func (l *ListOptionIndexer) ListByOptionsContext(ctx context.Context, lo ListOptions) ([]any, error) {
+	it, err := l.ListByOptionsIter(ctx, lo)
+	if err != nil {
+		return nil, err
+	}
+	return it.collect()
+}
+
+// ListByOptionsIter is like ListByOptionsContext, but returns an iterator decoding objects one at a time
+func (l *ListOptionIndexer) ListByOptionsIter(ctx context.Context, lo ListOptions) (*ObjectIterator, error) {
+	q, err := l.buildListQuery(ctx, lo, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	prepared, err := l.SafePrepareReadContext(ctx, q.stmt)
+	if err != nil {
+		return nil, err
+	}
+	it, err := l.queryObjectsIterOwningStmt(ctx, prepared, q.params...)
+	if err != nil {
+		return nil, err
+	}
+	it.keyset = q.keyset
+	return it, nil
+}
+
+// ListResult is a list of objects returned by ListByOptionsResult, along with metadata about the whole list
+type ListResult struct {
+	// Items are the listed objects
+	Items []any
+	// Total is the number of objects matching filters at Revision, across all pages or chunks
+	Total int
+	// Pages is the number of pages (or chunks) Total objects are split into, according to Pagination (or ChunkSize)
+	Pages int
+	// Revision is the revision objects were listed at
+	Revision string
+	// Continue is a token to get the next chunk via ListOptions.Resume, or "" if there are no more objects
+	Continue string
+}
+
+// ListByOptionsResult is like ListByOptionsContext, but also returns the total number of matching objects and other
+// metadata. Objects and their count are queried consistently, in the same read transaction
+func (l *ListOptionIndexer) ListByOptionsResult(ctx context.Context, lo ListOptions) (*ListResult, error) {
+	err := l.flush()
+	if err != nil {
+		return nil, err
+	}
+	tx, err := l.readDB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	result, err := l.listResult(ctx, lo, tx)
+	if err != nil {
+		return nil, l.rollback(err, tx)
+	}
+	return result, tx.Commit()
+}
+
+// listResult implements ListByOptionsResult as part of tx
+func (l *ListOptionIndexer) listResult(ctx context.Context, lo ListOptions, tx *sql.Tx) (*ListResult, error) {
+	q, err := l.buildListQuery(ctx, lo, tx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ListResult{Revision: q.revision}
+	if result.Revision == "" {
+		current, err := l.currentRevision(ctx, tx)
+		if err != nil {
+			return nil, err
+		}
+		result.Revision = strconv.Itoa(current)
+	}
+
+	err = tx.QueryRowContext(ctx, q.countStmt, q.countParams...).Scan(&result.Total)
+	if err != nil {
+		return nil, err
+	}
+	pageSize := lo.Pagination.pageSize
+	if lo.ChunkSize > 0 {
+		pageSize = lo.ChunkSize
+	}
+	if pageSize > 0 {
+		result.Pages = (result.Total + pageSize - 1) / pageSize
+	} else if result.Total > 0 {
+		result.Pages = 1
 	}
+
+	rows, err := tx.QueryContext(ctx, q.stmt, q.params...)
+	if err != nil {
+		return nil, err
+	}
+	it := &ObjectIterator{store: l.Store, ctx: ctx, rows: rows, keyset: q.keyset}
+	result.Items, err = it.collect()
+	if err != nil {
+		return nil, err
+	}
+	result.Continue, err = it.Continue()
+	return result, err
+}
+
+// listQuery is a query built from ListOptions, see buildListQuery
+type listQuery struct {
+	// stmt returns objects, followed by their sort values and key if keyset is not nil
+	stmt   string
+	params []any
+	// countStmt returns the number of objects matching filters at the listed revision, regardless of
+	// pagination and chunks
+	countStmt   string
+	countParams []any
+	// revision is the revision objects are listed at, "" for the latest
+	revision string
+	keyset   *keysetIterator
+}
+
+// buildListQuery returns a query listing objects according to lo. If tx is not nil, any other needed query runs
+// as part of it
+func (l *ListOptionIndexer) buildListQuery(ctx context.Context, lo ListOptions, tx *sql.Tx) (listQuery, error) {
+	err := l.Validate(lo)
+	if err != nil {
+		return listQuery{}, err
+	}
+
+	// compute sort columns (from lo.Sort). Multi-valued fields sort by their lowest element
+	sortColumns := []keysetColumn{}
 	if len(lo.Sort.primaryField) > 0 {
-		fields = append(fields, lo.Sort.primaryField)
+		column := sortFieldExpression(lo.Sort.primaryField)
+		column.desc = lo.Sort.primaryOrder == DESC
+		sortColumns = append(sortColumns, column)
 	}
 	if len(lo.Sort.secondaryField) > 0 {
-		fields = append(fields, lo.Sort.secondaryField)
+		column := sortFieldExpression(lo.Sort.secondaryField)
+		column.desc = lo.Sort.secondaryOrder == DESC
+		sortColumns = append(sortColumns, column)
 	}
 
-	// compute join clauses (one per interesting field) and their corresponding parameters
-	joinClauses := []string{}
-	params := []any{}
-	for _, field := range fields {
-		columnName := toColumnName(field)
-		joinClauses = append(joinClauses, fmt.Sprintf(`JOIN fields "f_%s" ON "f_%s".key = o.key AND "f_%s".version = o.version AND "f_%s".name = ?`, columnName, columnName, columnName, columnName))
-		params = append(params, columnName)
+	// chunked listings are pinned to a revision and ordered by key last, so that chunks are consistent
+	// and can be resumed after the last returned object
+	var keyset *keysetIterator
+	var token *continueToken
+	if lo.ChunkSize > 0 || lo.Resume != "" {
+		keyset = &keysetIterator{limit: lo.ChunkSize}
+		if lo.Resume != "" {
+			t, err := decodeContinueToken(lo.Resume)
+			if err != nil {
+				return listQuery{}, err
+			}
+			if lo.Revision != "" && lo.Revision != strconv.Itoa(t.Revision) {
+				return listQuery{}, errors.Errorf("Revision %s does not match continue token revision %d", lo.Revision, t.Revision)
+			}
+			if len(t.Values) != len(sortColumns) {
+				return listQuery{}, errors.Errorf("Continue token does not match sort fields")
+			}
+			err = l.checkNotCompacted(ctx, t.Revision, tx)
+			if err != nil {
+				return listQuery{}, err
+			}
+			keyset.revision = t.Revision
+			token = &t
+		} else if lo.Revision != "" {
+			keyset.revision, err = strconv.Atoi(lo.Revision)
+			if err != nil {
+				return listQuery{}, errors.Wrapf(err, "Could not parse Revision %s", lo.Revision)
+			}
+		} else {
+			keyset.revision, err = l.currentRevision(ctx, tx)
+			if err != nil {
+				return listQuery{}, err
+			}
+		}
+		lo.Revision = strconv.Itoa(keyset.revision)
+		sortColumns = append(sortColumns, keysetColumn{expression: "o.key"})
 	}
 
-	// compute WHERE clauses (from lo.Filters and lo.Revision) - and their corresponding parameters
-	whereClauses := []string{}
+	// compute SELECT clause. Chunked listings also return key and sort values, to produce continue tokens
+	selectClause := "o.object"
+	selectParams := []any{}
+	if keyset != nil {
+		var expressions string
+		expressions, selectParams = joinExpressions(sortColumns, false)
+		selectClause += ", " + expressions
+	}
+
+	// compute WHERE clauses (from lo.Namespaces, lo.LabelSelector, lo.FieldSelector, lo.Filters, lo.Revision and
+	// lo.Resume) - and their corresponding parameters
+	whereClauses, params, err := labelSelectorClauses(lo.LabelSelector)
+	if err != nil {
+		return listQuery{}, err
+	}
+	if clause, namespaceParams := namespacesClause(lo.Namespaces); clause != "" {
+		whereClauses = append([]string{clause}, whereClauses...)
+		params = append(namespaceParams, params...)
+	}
+	selectorClauses, selectorParams, err := l.fieldSelectorClauses(lo.FieldSelector)
+	if err != nil {
+		return listQuery{}, err
+	}
+	whereClauses = append(whereClauses, selectorClauses...)
+	params = append(params, selectorParams...)
 	for _, filter := range lo.Filters {
-		columnName := toColumnName(filter.field)
-		whereClauses = append(whereClauses, fmt.Sprintf(`"f_%s".value LIKE ?`, columnName))
-		params = append(params, fmt.Sprintf("%%%s%%", filter.match))
+		clause, filterParams, err := l.filterClause(filter)
+		if err != nil {
+			return listQuery{}, err
+		}
+		whereClauses = append(whereClauses, clause)
+		params = append(params, filterParams...)
 	}
 	if lo.Revision == "" {
 		// latest
@@ -194,37 +435,34 @@ func (l *ListOptionIndexer) ListByOptions(lo ListOptions) ([]any, error) {
 	} else {
 		version, err := strconv.Atoi(lo.Revision)
 		if err != nil {
-			return nil, errors.Wrapf(err, "Could not parse Revision %s", lo.Revision)
+			return listQuery{}, errors.Wrapf(err, "Could not parse Revision %s", lo.Revision)
 		}
 		whereClauses = append(whereClauses, "o.version = (SELECT MAX(o2.version) FROM object_history o2 WHERE o2.key = o.key AND o2.version <= ?)")
 		params = append(params, version)
 		whereClauses = append(whereClauses, "(o.deleted_version IS NULL OR o.deleted_version > ?)")
 		params = append(params, version)
 	}
-
-	// compute ORDER BY clauses (from lo.Sort)
-	orderByClauses := []string{}
-	if len(lo.Sort.primaryField) > 0 {
-		columnName := toColumnName(lo.Sort.primaryField)
-		direction := "ASC"
-		if lo.Sort.primaryOrder == DESC {
-			direction = "DESC"
-		}
-		orderByClauses = append(orderByClauses, fmt.Sprintf(`"f_%s".value %s`, columnName, direction))
-	}
-	if len(lo.Sort.secondaryField) > 0 {
-		columnName := toColumnName(lo.Sort.secondaryField)
-		direction := "ASC"
-		if lo.Sort.secondaryOrder == DESC {
-			direction = "DESC"
-		}
-		orderByClauses = append(orderByClauses, fmt.Sprintf(`"f_%s".value %s`, columnName, direction))
+	// counts ignore chunks
+	countWhereClauses := append([]string{}, whereClauses...)
+	countParams := append([]any{}, params...)
+	if token != nil {
+		clause, keysetParams := keysetClause(sortColumns, append(append([]any{}, token.Values...), token.Key))
+		whereClauses = append(whereClauses, clause)
+		params = append(params, keysetParams...)
 	}
 
-	// compute LIMIT/OFFSET clauses (from lo.Pagination)
+	// compute ORDER BY clause
+	orderByClause, orderByParams := joinExpressions(sortColumns, true)
+	params = append(params, orderByParams...)
+
+	// compute LIMIT/OFFSET clauses (from lo.Pagination or lo.ChunkSize)
 	limitClause := ""
 	offsetClause := ""
-	if lo.Pagination.pageSize >= 1 {
+	if lo.ChunkSize > 0 {
+		// one more object tells whether there are more chunks
+		limitClause = " LIMIT ?"
+		params = append(params, lo.ChunkSize+1)
+	} else if lo.Pagination.pageSize >= 1 {
 		limitClause = " LIMIT ?"
 		params = append(params, lo.Pagination.pageSize)
 
@@ -235,32 +473,138 @@ func (l *ListOptionIndexer) ListByOptions(lo ListOptions) ([]any, error) {
 	}
 
 	// put the final query together
-	stmt := `SELECT o.object FROM object_history o`
-	if len(joinClauses) > 0 {
-		stmt += " "
-		stmt += strings.Join(joinClauses, " ")
-	}
+	stmt := "SELECT " + selectClause + " FROM object_history o"
 	if len(whereClauses) > 0 {
 		stmt += " WHERE "
 		stmt += strings.Join(whereClauses, " AND ")
 	}
-	if len(orderByClauses) > 0 {
+	if len(sortColumns) > 0 {
 		stmt += " ORDER BY "
-		stmt += strings.Join(orderByClauses, ", ")
+		stmt += orderByClause
 	}
 	stmt += limitClause
 	stmt += offsetClause
 
-	result, err := l.QueryObjects(l.Prepare(stmt), params...)
-	if err != nil {
-		return nil, err
-	}
+	return listQuery{
+		stmt:        stmt,
+		params:      append(selectParams, params...),
+		countStmt:   "SELECT COUNT(*) FROM object_history o WHERE " + strings.Join(countWhereClauses, " AND "),
+		countParams: countParams,
+		revision:    lo.Revision,
+		keyset:      keyset,
+	}, nil
+}
 
-	return result, nil
+// currentRevision returns the latest version or deletion version stored. If tx is not nil, it is queried as part of it
+func (l *ListOptionIndexer) currentRevision(ctx context.Context, tx *sql.Tx) (int, error) {
+	stmt := l.currentRevisionStmt
+	if tx != nil {
+		stmt = tx.StmtContext(ctx, stmt)
+	} else {
+		err := l.flush()
+		if err != nil {
+			return 0, err
+		}
+	}
+	var result int
+	err := stmt.QueryRowContext(ctx).Scan(&result)
+	return result, err
 }
 
 /* Utilities */
 
+// fieldMatchClause matches rows of fields of the object_history row o, for the field name passed as parameter
+const fieldMatchClause = "f.name = ? AND f.key = o.key AND f.version = o.version"
+
+// filterClause returns a WHERE clause for filter, with its corresponding parameters
+func (l *ListOptionIndexer) filterClause(filter Filter) (string, []any, error) {
+	if filter.or != nil {
+		clauses := []string{}
+		params := []any{}
+		for _, alternative := range filter.or {
+			clause, alternativeParams, err := l.filterClause(alternative)
+			if err != nil {
+				return "", nil, err
+			}
+			clauses = append(clauses, clause)
+			params = append(params, alternativeParams...)
+		}
+		return "(" + strings.Join(clauses, " OR ") + ")", params, nil
+	}
+
+	// each field value is a row, filters match objects having any (or, if negated, no) matching row
+	fieldType := l.fieldTypes[toColumnName(filter.field)]
+	params := []any{toColumnName(filter.field)}
+	switch filter.op {
+	case FilterContains:
+		params = append(params, fmt.Sprintf("%%%s%%", filter.match))
+		return "EXISTS (SELECT 1 FROM fields f WHERE " + fieldMatchClause + " AND f.value LIKE ?)", params, nil
+	case FilterPrefix:
+		// unlike LIKE, instr is case-sensitive and has no wildcards
+		params = append(params, filter.match)
+		return "EXISTS (SELECT 1 FROM fields f WHERE " + fieldMatchClause + " AND instr(f.value, ?) = 1)", params, nil
+	case FilterEquals, FilterNotEquals:
+		match, err := fieldType.parse(filter.match)
+		if err != nil {
+			return "", nil, err
+		}
+		params = append(params, match)
+		clause := "EXISTS (SELECT 1 FROM fields f WHERE " + fieldMatchClause + " AND f.value = ?)"
+		if filter.op == FilterNotEquals {
+			return "NOT " + clause, params, nil
+		}
+		return clause, params, nil
+	case FilterIn, FilterNotIn, FilterContainsAll:
+		distinct := map[any]bool{}
+		for _, match := range filter.matches {
+			param, err := fieldType.parse(match)
+			if err != nil {
+				return "", nil, err
+			}
+			if !distinct[param] {
+				distinct[param] = true
+				params = append(params, param)
+			}
+		}
+		placeholders := strings.TrimPrefix(strings.Repeat(", ?", len(distinct)), ", ")
+		if filter.op == FilterContainsAll {
+			params = append(params, len(distinct))
+			return "(SELECT COUNT(DISTINCT f.value) FROM fields f WHERE " + fieldMatchClause + " AND f.value IN (" + placeholders + ")) = ?", params, nil
+		}
+		clause := "EXISTS (SELECT 1 FROM fields f WHERE " + fieldMatchClause + " AND f.value IN (" + placeholders + "))"
+		if filter.op == FilterNotIn {
+			return "NOT " + clause, params, nil
+		}
+		return clause, params, nil
+	case FilterLessThan, FilterLessThanOrEqual, FilterGreaterThan, FilterGreaterThanOrEqual:
+		operator := filterOpSymbols[filter.op]
+		if fieldType != StringField {
+			// typed values compare natively
+			match, err := fieldType.parse(filter.match)
+			if err != nil {
+				return "", nil, err
+			}
+			params = append(params, match)
+			return "EXISTS (SELECT 1 FROM fields f WHERE " + fieldMatchClause + " AND f.value " + operator + " ?)", params, nil
+		}
+		operand, err := rangeOperand(filter.match)
+		if err != nil {
+			return "", nil, err
+		}
+		params = append(params, operand)
+		if _, ok := operand.(string); ok {
+			// timestamps are compared as julian day numbers, so that different time zones compare correctly
+			return "EXISTS (SELECT 1 FROM fields f WHERE " + fieldMatchClause + " AND julianday(f.value) " + operator + " julianday(?))", params, nil
+		}
+		return "EXISTS (SELECT 1 FROM fields f WHERE " + fieldMatchClause + " AND CAST(f.value AS REAL) " + operator + " ?)", params, nil
+	case FilterExists:
+		return "EXISTS (SELECT 1 FROM fields f WHERE " + fieldMatchClause + " AND f.value IS NOT NULL)", params, nil
+	case FilterNotExists:
+		return "NOT EXISTS (SELECT 1 FROM fields f WHERE " + fieldMatchClause + " AND f.value IS NOT NULL)", params, nil
+	}
+	return "", nil, errors.Errorf("Unknown filter operator %d", filter.op)
+}
+
 func toColumnName(s []string) string {
 	return sanitize(strings.Join(s, "."))
 }
@@ -7,11 +7,20 @@ Adapted from client-go, Copyright 2014 The Kubernetes Authors.
 package sqlcache
 
 import (
+	"context"
+	"fmt"
 	"github.com/stretchr/testify/assert"
 	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/cache"
+	"math"
+	"net/url"
 	"strconv"
 	"testing"
+	"time"
 )
 
 func brandfunc(c any) any {
@@ -28,18 +37,197 @@ var fieldFunc = map[string]FieldFunc{
 }
 
 func TestListOptionIndexer(t *testing.T) {
+	for name, codec := range testKubernetesCodecs() {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			l, err := NewListOptionIndexer(&v1.Pod{}, TEST_DB_LOCATION, fieldFunc, WithCodec(codec))
+			if err != nil {
+				t.Error(err)
+			}
+
+			revision := 1
+			red := &v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:            "testa rossa",
+					ResourceVersion: strconv.Itoa(revision),
+					Labels: map[string]string{
+						"Brand": "ferrari",
+						"Color": "red",
+					},
+				},
+			}
+			err = l.Add(red)
+			if err != nil {
+				t.Error(err)
+			}
+
+			// add two v1.Pods and list with default options
+			revision++
+			blue := &v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:            "focus",
+					ResourceVersion: strconv.Itoa(revision),
+					Labels: map[string]string{
+						"Brand": "ford",
+						"Color": "blue",
+					},
+				},
+			}
+			err = l.Add(blue)
+			if err != nil {
+				t.Error(err)
+			}
+
+			lo := ListOptions{
+				Filters:    nil,
+				Sort:       Sort{},
+				Pagination: Pagination{},
+				Revision:   "",
+			}
+			r, err := l.ListByOptions(lo)
+			if err != nil {
+				t.Error(err)
+			}
+			assert.Len(r, 2)
+
+			// delete one and list again. Should be gone
+			err = l.Delete(red)
+			if err != nil {
+				t.Error(err)
+			}
+			r, err = l.ListByOptions(lo)
+			if err != nil {
+				t.Error(err)
+			}
+			assert.Len(r, 1)
+			assert.Equal(r[0].(*v1.Pod).Name, "focus")
+			// gone also from most-recent store
+			r = l.List()
+			assert.Len(r, 1)
+			assert.Equal(r[0].(*v1.Pod).Name, "focus")
+
+			// updating the v1.Pod brings it back
+			revision++
+			red.ResourceVersion = strconv.Itoa(revision)
+			red.Labels["Wheels"] = "3"
+			err = l.Update(red)
+			if err != nil {
+				t.Error(err)
+			}
+			r = l.List()
+			assert.Len(r, 2)
+			lo = ListOptions{
+				Filters:    []Filter{{field: []string{"Brand"}, match: "ferrari"}},
+				Sort:       Sort{},
+				Pagination: Pagination{},
+				Revision:   "",
+			}
+			r, err = l.ListByOptions(lo)
+			if err != nil {
+				t.Error(err)
+			}
+			assert.Len(r, 1)
+			assert.Equal(r[0].(*v1.Pod).Name, "testa rossa")
+			assert.Equal(r[0].(*v1.Pod).ResourceVersion, "3")
+			assert.Equal(r[0].(*v1.Pod).Labels["Wheels"], "3")
+
+			// historically, v1.Pod still exists in version 1, gone in version 2, back in version 3
+			lo = ListOptions{
+				Filters:    []Filter{{field: []string{"Brand"}, match: "ferrari"}},
+				Sort:       Sort{},
+				Pagination: Pagination{},
+				Revision:   "1",
+			}
+			r, err = l.ListByOptions(lo)
+			if err != nil {
+				t.Error(err)
+			}
+			assert.Len(r, 1)
+			lo.Revision = "2"
+			r, err = l.ListByOptions(lo)
+			if err != nil {
+				t.Error(err)
+			}
+			assert.Len(r, 0)
+			lo.Revision = "3"
+			r, err = l.ListByOptions(lo)
+			if err != nil {
+				t.Error(err)
+			}
+			assert.Len(r, 1)
+
+			// add another v1.Pod, test filter by substring and sorting
+			revision++
+			black := &v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:            "model 3",
+					ResourceVersion: strconv.Itoa(revision),
+					Labels: map[string]string{
+						"Brand": "tesla",
+						"Color": "black",
+					},
+				},
+			}
+			err = l.Add(black)
+			if err != nil {
+				t.Error(err)
+			}
+			lo = ListOptions{
+				Filters:    []Filter{{field: []string{"Brand"}, match: "f"}}, // tesla filtered out
+				Sort:       Sort{primaryField: []string{"Color"}, primaryOrder: DESC},
+				Pagination: Pagination{},
+				Revision:   "",
+			}
+			r, err = l.ListByOptions(lo)
+			if err != nil {
+				t.Error(err)
+			}
+			assert.Len(r, 2)
+			assert.Equal(r[0].(*v1.Pod).Labels["Color"], "red")
+			assert.Equal(r[1].(*v1.Pod).Labels["Color"], "blue")
+
+			// test pagination
+			lo = ListOptions{
+				Filters:    []Filter{},
+				Sort:       Sort{primaryField: []string{"Color"}},
+				Pagination: Pagination{pageSize: 2},
+				Revision:   "",
+			}
+			r, err = l.ListByOptions(lo)
+			if err != nil {
+				t.Error(err)
+			}
+			assert.Len(r, 2)
+			assert.Equal(r[0].(*v1.Pod).Labels["Color"], "black")
+			assert.Equal(r[1].(*v1.Pod).Labels["Color"], "blue")
+			lo.Pagination.page = 2
+			r, err = l.ListByOptions(lo)
+			if err != nil {
+				t.Error(err)
+			}
+			assert.Len(r, 1)
+			assert.Equal(r[0].(*v1.Pod).Labels["Color"], "red")
+
+			err = l.Close()
+			if err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestListOptionIndexerReopen(t *testing.T) {
 	assert := assert.New(t)
 
 	l, err := NewListOptionIndexer(&v1.Pod{}, TEST_DB_LOCATION, fieldFunc)
 	if err != nil {
 		t.Error(err)
 	}
-
-	revision := 1
 	red := &v1.Pod{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:            "testa rossa",
-			ResourceVersion: strconv.Itoa(revision),
+			ResourceVersion: "1",
 			Labels: map[string]string{
 				"Brand": "ferrari",
 				"Color": "red",
@@ -50,156 +238,910 @@ func TestListOptionIndexer(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-
-	// add two v1.Pods and list with default options
-	revision++
-	blue := &v1.Pod{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:            "focus",
-			ResourceVersion: strconv.Itoa(revision),
-			Labels: map[string]string{
-				"Brand": "ford",
-				"Color": "blue",
-			},
-		},
-	}
-	err = l.Add(blue)
+	err = l.Close()
 	if err != nil {
 		t.Error(err)
 	}
 
-	lo := ListOptions{
-		Filters:    nil,
-		Sort:       Sort{},
-		Pagination: Pagination{},
-		Revision:   "",
-	}
-	r, err := l.ListByOptions(lo)
+	// objects, history and fields survive reopening
+	l, err = NewListOptionIndexer(&v1.Pod{}, TEST_DB_LOCATION, fieldFunc, WithReopen())
 	if err != nil {
 		t.Error(err)
 	}
-	assert.Len(r, 2)
-
-	// delete one and list again. Should be gone
-	err = l.Delete(red)
+	r, err := l.ListByOptions(ListOptions{Filters: []Filter{{field: []string{"Color"}, match: "red"}}})
 	if err != nil {
 		t.Error(err)
 	}
-	r, err = l.ListByOptions(lo)
+	assert.Len(r, 1)
+	assert.Equal("testa rossa", r[0].(*v1.Pod).Name)
+	_, found, err := l.GetByKeyAndVersion("testa rossa", 1)
 	if err != nil {
 		t.Error(err)
 	}
-	assert.Len(r, 1)
-	assert.Equal(r[0].(*v1.Pod).Name, "focus")
-	// gone also from most-recent store
-	r = l.List()
-	assert.Len(r, 1)
-	assert.Equal(r[0].(*v1.Pod).Name, "focus")
-
-	// updating the v1.Pod brings it back
-	revision++
-	red.ResourceVersion = strconv.Itoa(revision)
-	red.Labels["Wheels"] = "3"
-	err = l.Update(red)
+	assert.True(found)
+	err = l.Close()
 	if err != nil {
 		t.Error(err)
 	}
-	r = l.List()
+
+	// different fields are detected
+	_, err = NewListOptionIndexer(&v1.Pod{}, TEST_DB_LOCATION, map[string]FieldFunc{"Brand": brandfunc}, WithReopen())
+	assert.Error(err)
+}
+
+func TestListOptionIndexerReplaceKeepsHistory(t *testing.T) {
+	assert := assert.New(t)
+
+	l, err := NewListOptionIndexer(&v1.Pod{}, TEST_DB_LOCATION, fieldFunc)
+	assert.NoError(err)
+
+	red := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "testa rossa", ResourceVersion: "1", Labels: map[string]string{"Color": "red"}}}
+	blue := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "focus", ResourceVersion: "2", Labels: map[string]string{"Color": "blue"}}}
+	assert.NoError(l.Replace([]any{red, blue}, "2"))
+
+	// relisting the same objects does not touch history
+	assert.NoError(l.Replace([]any{red, blue}, "5"))
+	var count int
+	assert.NoError(l.db.QueryRow(`SELECT COUNT(*) FROM object_history WHERE deleted_version IS NULL`).Scan(&count))
+	assert.Equal(2, count)
+	r, err := l.ListByOptions(ListOptions{Revision: "4"})
+	assert.NoError(err)
+	assert.Len(r, 2)
+
+	// relisting without one object deletes it, at the relisting's revision
+	assert.NoError(l.Replace([]any{blue}, "6"))
+	r, err = l.ListByOptions(ListOptions{})
+	assert.NoError(err)
+	assert.Len(r, 1)
+	assert.Equal("focus", r[0].(*v1.Pod).Name)
+	r, err = l.ListByOptions(ListOptions{Revision: "5"})
+	assert.NoError(err)
 	assert.Len(r, 2)
-	lo = ListOptions{
-		Filters:    []Filter{{field: []string{"Brand"}, match: "ferrari"}},
-		Sort:       Sort{},
-		Pagination: Pagination{},
-		Revision:   "",
+
+	assert.NoError(l.Close())
+}
+
+func TestListOptionIndexerDeletionVersions(t *testing.T) {
+	assert := assert.New(t)
+
+	l, err := NewListOptionIndexer(&v1.Pod{}, TEST_DB_LOCATION, fieldFunc)
+	assert.NoError(err)
+	names := func(revision string) []string {
+		r, err := l.ListByOptions(ListOptions{Revision: revision})
+		assert.NoError(err)
+		result := []string{}
+		for _, item := range r {
+			result = append(result, item.(*v1.Pod).Name)
+		}
+		return result
 	}
-	r, err = l.ListByOptions(lo)
-	if err != nil {
-		t.Error(err)
+	pod := func(name string, revision string) *v1.Pod {
+		return &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name, ResourceVersion: revision}}
 	}
-	assert.Len(r, 1)
-	assert.Equal(r[0].(*v1.Pod).Name, "testa rossa")
-	assert.Equal(r[0].(*v1.Pod).ResourceVersion, "3")
-	assert.Equal(r[0].(*v1.Pod).Labels["Wheels"], "3")
-
-	// historically, v1.Pod still exists in version 1, gone in version 2, back in version 3
-	lo = ListOptions{
-		Filters:    []Filter{{field: []string{"Brand"}, match: "ferrari"}},
-		Sort:       Sort{},
-		Pagination: Pagination{},
-		Revision:   "1",
-	}
-	r, err = l.ListByOptions(lo)
-	if err != nil {
-		t.Error(err)
+
+	assert.NoError(l.Add(pod("red", "1")))
+	assert.NoError(l.Add(pod("blue", "2")))
+	assert.NoError(l.Add(pod("yellow", "3")))
+
+	// final states carry the deletion's revision
+	assert.NoError(l.Delete(pod("red", "5")))
+	assert.ElementsMatch([]string{"red", "blue", "yellow"}, names("4"))
+	assert.ElementsMatch([]string{"blue", "yellow"}, names("5"))
+	_, exists, err := l.GetByKeyAndVersion("red", 1)
+	assert.NoError(err)
+	assert.True(exists)
+
+	// without a final state, deletions are assumed to happen after the latest known revision
+	assert.NoError(l.Delete(cache.DeletedFinalStateUnknown{Key: "blue", Obj: pod("blue", "2")}))
+	assert.ElementsMatch([]string{"red", "blue", "yellow"}, names("4"))
+	assert.ElementsMatch([]string{"yellow"}, names("5"))
+	assert.NoError(l.Add(pod("yellow", "6")))
+	assert.NoError(l.DeleteByKey("yellow"))
+	assert.ElementsMatch([]string{"yellow"}, names("6"))
+	assert.ElementsMatch([]string{}, names("7"))
+
+	// recreated objects do not alter past deletions
+	assert.NoError(l.Add(pod("red", "8")))
+	assert.ElementsMatch([]string{"red", "blue", "yellow"}, names("3"))
+	assert.ElementsMatch([]string{}, names("7"))
+	assert.ElementsMatch([]string{"red"}, names("8"))
+
+	assert.NoError(l.Close())
+}
+
+func TestListOptionIndexerFilterOperators(t *testing.T) {
+	assert := assert.New(t)
+
+	fieldFuncs := map[string]FieldFunc{
+		"Brand": brandfunc,
+		"Color": colorfunc,
+		"Seats": func(c any) any {
+			seats, _ := strconv.Atoi(c.(*v1.Pod).Labels["Seats"])
+			return seats
+		},
+		"metadata.creationTimestamp": func(c any) any {
+			return c.(*v1.Pod).CreationTimestamp.UTC().Format(time.RFC3339)
+		},
+		"Owner": func(c any) any {
+			owner, ok := c.(*v1.Pod).Labels["Owner"]
+			if !ok {
+				return nil
+			}
+			return owner
+		},
 	}
-	assert.Len(r, 1)
-	lo.Revision = "2"
-	r, err = l.ListByOptions(lo)
-	if err != nil {
-		t.Error(err)
+	l, err := NewListOptionIndexer(&v1.Pod{}, TEST_DB_LOCATION, fieldFuncs)
+	assert.NoError(err)
+
+	cars := []struct {
+		name    string
+		labels  map[string]string
+		created string
+	}{
+		{"testa rossa", map[string]string{"Brand": "ferrari", "Color": "red", "Seats": "2", "Owner": "alice"}, "2023-01-01T00:00:00Z"},
+		{"purosangue", map[string]string{"Brand": "Ferrari", "Color": "Rosso", "Seats": "4"}, "2023-06-01T00:00:00Z"},
+		{"focus", map[string]string{"Brand": "ford", "Color": "blue", "Seats": "5", "Owner": "bob"}, "2023-06-01T12:00:00+02:00"},
+		{"model s", map[string]string{"Brand": "tesla", "Color": "red", "Seats": "7"}, "2024-01-01T00:00:00Z"},
 	}
-	assert.Len(r, 0)
-	lo.Revision = "3"
-	r, err = l.ListByOptions(lo)
-	if err != nil {
-		t.Error(err)
+	for i, car := range cars {
+		created, err := time.Parse(time.RFC3339, car.created)
+		assert.NoError(err)
+		assert.NoError(l.Add(&v1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Name:              car.name,
+			ResourceVersion:   strconv.Itoa(i + 1),
+			Labels:            car.labels,
+			CreationTimestamp: metav1.NewTime(created),
+		}}))
 	}
-	assert.Len(r, 1)
 
-	// add another v1.Pod, test filter by substring and sorting
-	revision++
-	black := &v1.Pod{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:            "model 3",
-			ResourceVersion: strconv.Itoa(revision),
-			Labels: map[string]string{
-				"Brand": "tesla",
-				"Color": "black",
+	tests := []struct {
+		name     string
+		filters  []Filter
+		expected []string
+	}{
+		{"contains", []Filter{NewFilter("Brand", "err")}, []string{"testa rossa", "purosangue"}},
+		{"equals", []Filter{NewFilterOp("Brand", FilterEquals, "ferrari")}, []string{"testa rossa"}},
+		{"not equals", []Filter{NewFilterOp("Color", FilterNotEquals, "red")}, []string{"purosangue", "focus"}},
+		{"not equals absent", []Filter{NewFilterOp("Owner", FilterNotEquals, "alice")}, []string{"purosangue", "focus", "model s"}},
+		{"prefix", []Filter{NewFilterOp("Brand", FilterPrefix, "F")}, []string{"purosangue"}},
+		{"prefix without wildcards", []Filter{NewFilterOp("Brand", FilterPrefix, "f_")}, []string{}},
+		{"in", []Filter{NewFilterOp("Color", FilterIn, "blue", "Rosso")}, []string{"purosangue", "focus"}},
+		{"in empty", []Filter{NewFilterOp("Color", FilterIn)}, []string{}},
+		{"not in", []Filter{NewFilterOp("Owner", FilterNotIn, "alice", "carol")}, []string{"purosangue", "focus", "model s"}},
+		{"less than", []Filter{NewFilterOp("Seats", FilterLessThan, "5")}, []string{"testa rossa", "purosangue"}},
+		{"less than or equal", []Filter{NewFilterOp("Seats", FilterLessThanOrEqual, "5")}, []string{"testa rossa", "purosangue", "focus"}},
+		{"greater than", []Filter{NewFilterOp("Seats", FilterGreaterThan, "4.5")}, []string{"focus", "model s"}},
+		{"greater than or equal", []Filter{NewFilterOp("Seats", FilterGreaterThanOrEqual, "10")}, []string{}},
+		{"before", []Filter{NewFilterOp("metadata.creationTimestamp", FilterLessThan, "2023-06-01T00:00:00Z")}, []string{"testa rossa"}},
+		{"after, other time zone", []Filter{NewFilterOp("metadata.creationTimestamp", FilterGreaterThanOrEqual, "2023-06-01T11:00:00+01:00")}, []string{"focus", "model s"}},
+		{"exists", []Filter{NewFilterOp("Owner", FilterExists)}, []string{"testa rossa", "focus"}},
+		{"not exists", []Filter{NewFilterOp("Owner", FilterNotExists)}, []string{"purosangue", "model s"}},
+		{"and", []Filter{NewFilter("Color", "r"), NewFilterOp("Seats", FilterGreaterThan, "3")}, []string{"purosangue", "model s"}},
+		{"or", []Filter{NewOrFilter(NewFilterOp("Brand", FilterEquals, "tesla"), NewFilterOp("Owner", FilterEquals, "bob"))}, []string{"focus", "model s"}},
+		{"or and", []Filter{
+			NewOrFilter(NewFilterOp("Color", FilterEquals, "red"), NewFilterOp("Color", FilterEquals, "blue")),
+			NewOrFilter(NewFilterOp("Owner", FilterExists), NewFilterOp("Seats", FilterGreaterThan, "6")),
+		}, []string{"testa rossa", "focus", "model s"}},
+	}
+	for _, test := range tests {
+		r, err := l.ListByOptions(ListOptions{Filters: test.filters})
+		assert.NoError(err, test.name)
+		names := []string{}
+		for _, item := range r {
+			names = append(names, item.(*v1.Pod).Name)
+		}
+		assert.ElementsMatch(test.expected, names, test.name)
+	}
+
+	// invalid filters
+	for _, filter := range []Filter{
+		NewFilterOp("Seats", FilterLessThan, "many"),
+		NewFilterOp("Owner", FilterExists, "alice"),
+		NewFilterOp("Brand", FilterEquals, "ferrari", "ford"),
+		NewOrFilter(),
+	} {
+		_, err = l.ListByOptions(ListOptions{Filters: []Filter{filter}})
+		assert.Error(err)
+	}
+
+	assert.NoError(l.Close())
+}
+
+func TestListOptionIndexerFieldTypes(t *testing.T) {
+	assert := assert.New(t)
+
+	fieldFuncs := map[string]FieldFunc{
+		"metadata.name": func(c any) any {
+			return c.(*v1.Pod).Name
+		},
+		"status.restartCount": func(c any) any {
+			return c.(*v1.Pod).Status.ContainerStatuses[0].RestartCount
+		},
+		"Load": func(c any) any {
+			return c.(*v1.Pod).Labels["Load"]
+		},
+		"Ready": func(c any) any {
+			return c.(*v1.Pod).Status.ContainerStatuses[0].Ready
+		},
+		"metadata.creationTimestamp": func(c any) any {
+			return c.(*v1.Pod).CreationTimestamp
+		},
+		"status.startTime": func(c any) any {
+			return c.(*v1.Pod).Status.StartTime
+		},
+	}
+	types := map[string]FieldType{
+		"status.restartCount":        IntField,
+		"Load":                       FloatField,
+		"Ready":                      BoolField,
+		"metadata.creationTimestamp": TimeField,
+		"status.startTime":           TimeField,
+	}
+	l, err := NewListOptionIndexer(&v1.Pod{}, TEST_DB_LOCATION, fieldFuncs, WithFieldTypes(types))
+	assert.NoError(err)
+
+	pods := []struct {
+		name     string
+		restarts int32
+		load     string
+		ready    bool
+		created  string
+	}{
+		{"a", 10, "0.5", true, "2023-06-01T12:00:00+02:00"},
+		{"b", 9, "10", false, "2023-06-01T11:00:00Z"},
+		{"c", 100, "2.25", true, "2023-06-01T10:30:00Z"},
+	}
+	for i, p := range pods {
+		created, err := time.Parse(time.RFC3339, p.created)
+		assert.NoError(err)
+		pod := &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:              p.name,
+				ResourceVersion:   strconv.Itoa(i + 1),
+				Labels:            map[string]string{"Load": p.load},
+				CreationTimestamp: metav1.NewTime(created),
 			},
+			Status: v1.PodStatus{ContainerStatuses: []v1.ContainerStatus{{RestartCount: p.restarts, Ready: p.ready}}},
+		}
+		if p.ready {
+			pod.Status.StartTime = &pod.CreationTimestamp
+		}
+		assert.NoError(l.Add(pod))
+	}
+
+	list := func(lo ListOptions) []string {
+		r, err := l.ListByOptions(lo)
+		assert.NoError(err)
+		result := []string{}
+		for _, item := range r {
+			result = append(result, item.(*v1.Pod).Name)
+		}
+		return result
+	}
+
+	// sorting
+	assert.Equal([]string{"b", "a", "c"}, list(ListOptions{Sort: NewSort("status.restartCount", ASC)}))
+	assert.Equal([]string{"b", "c", "a"}, list(ListOptions{Sort: NewSort("Load", DESC)}))
+	assert.Equal([]string{"b", "a", "c"}, list(ListOptions{Sort: NewSort("Ready", ASC).ThenBy("metadata.name", ASC)}))
+	// 12:00+02:00 is 10:00Z
+	assert.Equal([]string{"a", "c", "b"}, list(ListOptions{Sort: NewSort("metadata.creationTimestamp", ASC)}))
+
+	// filtering
+	assert.Equal([]string{"a", "c"}, list(ListOptions{
+		Filters: []Filter{NewFilterOp("status.restartCount", FilterGreaterThanOrEqual, "10")},
+		Sort:    NewSort("metadata.name", ASC),
+	}))
+	assert.Equal([]string{"b"}, list(ListOptions{Filters: []Filter{NewFilterOp("status.restartCount", FilterEquals, "9")}}))
+	assert.Equal([]string{"b"}, list(ListOptions{Filters: []Filter{NewFilterOp("Load", FilterEquals, "10.0")}}))
+	assert.Equal([]string{"a", "c"}, list(ListOptions{
+		Filters: []Filter{NewFilterOp("Load", FilterIn, "0.5", "2.25")},
+		Sort:    NewSort("metadata.name", ASC),
+	}))
+	assert.Equal([]string{"b"}, list(ListOptions{Filters: []Filter{NewFilterOp("Ready", FilterEquals, "false")}}))
+	assert.Equal([]string{"a", "c"}, list(ListOptions{
+		Filters: []Filter{NewFilterOp("metadata.creationTimestamp", FilterLessThan, "2023-06-01T12:00:00+01:00")},
+		Sort:    NewSort("metadata.name", ASC),
+	}))
+	assert.Equal([]string{"a"}, list(ListOptions{Filters: []Filter{NewFilterOp("metadata.creationTimestamp", FilterEquals, "2023-06-01T10:00:00Z")}}))
+	assert.Equal([]string{"b"}, list(ListOptions{Filters: []Filter{NewFilterOp("status.startTime", FilterNotExists)}}))
+
+	// matches must be comparable
+	for _, filter := range []Filter{
+		NewFilterOp("status.restartCount", FilterLessThan, "ten"),
+		NewFilterOp("Ready", FilterIn, "yes"),
+		NewFilterOp("metadata.creationTimestamp", FilterGreaterThan, "yesterday"),
+	} {
+		assert.Error(l.Validate(ListOptions{Filters: []Filter{filter}}))
+	}
+
+	// FieldFunc results must be convertible
+	err = l.Add(&v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "d", ResourceVersion: "4", Labels: map[string]string{"Load": "high"}},
+		Status:     v1.PodStatus{ContainerStatuses: []v1.ContainerStatus{{}}},
+	})
+	assert.Error(err)
+	// unsigned integers must fit IntFields
+	for _, value := range []any{uint(7), uint64(7), uint64(math.MaxInt64)} {
+		_, err = IntField.toSQL(value)
+		assert.NoError(err, value)
+	}
+	_, err = IntField.toSQL(uint64(math.MaxInt64) + 1)
+	assert.Error(err)
+	assert.NoError(l.Close())
+
+	// types are checked when reopening
+	_, err = NewListOptionIndexer(&v1.Pod{}, TEST_DB_LOCATION, fieldFuncs, WithReopen())
+	assert.Error(err)
+
+	// types must refer to existing fields
+	_, err = NewListOptionIndexer(&v1.Pod{}, TEST_DB_LOCATION, fieldFunc, WithFieldTypes(types))
+	assert.ErrorIs(err, ErrUnknownField)
+}
+
+func TestListOptionIndexerMultiValuedFields(t *testing.T) {
+	assert := assert.New(t)
+
+	fieldFuncs := map[string]FieldFunc{
+		"spec.containers.image": func(c any) any {
+			images := []string{}
+			for _, container := range c.(*v1.Pod).Spec.Containers {
+				images = append(images, container.Image)
+			}
+			return images
+		},
+		"metadata.name": func(c any) any {
+			return c.(*v1.Pod).Name
+		},
+		"Ports": func(c any) any {
+			ports := []string{}
+			for _, container := range c.(*v1.Pod).Spec.Containers {
+				for _, port := range container.Ports {
+					ports = append(ports, strconv.Itoa(int(port.ContainerPort)))
+				}
+			}
+			return ports
 		},
 	}
-	err = l.Add(black)
-	if err != nil {
-		t.Error(err)
+	l, err := NewListOptionIndexer(&v1.Pod{}, TEST_DB_LOCATION, fieldFuncs, WithFieldTypes(map[string]FieldType{"Ports": IntField}))
+	assert.NoError(err)
+
+	pod := func(name string, revision string, images ...string) *v1.Pod {
+		p := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name, ResourceVersion: revision}}
+		for i, image := range images {
+			p.Spec.Containers = append(p.Spec.Containers, v1.Container{
+				Image: image,
+				Ports: []v1.ContainerPort{{ContainerPort: int32(8080 + 100*i)}},
+			})
+		}
+		return p
 	}
-	lo = ListOptions{
-		Filters:    []Filter{{field: []string{"Brand"}, match: "f"}}, // tesla filtered out
-		Sort:       Sort{primaryField: []string{"Color"}, primaryOrder: DESC},
-		Pagination: Pagination{},
-		Revision:   "",
+	assert.NoError(l.Add(pod("web", "1", "nginx", "envoy")))
+	assert.NoError(l.Add(pod("proxy", "2", "nginx-proxy")))
+	assert.NoError(l.Add(pod("mesh", "3", "envoy", "nginx", "redis")))
+	assert.NoError(l.Add(pod("empty", "4")))
+
+	list := func(lo ListOptions) []string {
+		r, err := l.ListByOptions(lo)
+		assert.NoError(err)
+		result := []string{}
+		for _, item := range r {
+			result = append(result, item.(*v1.Pod).Name)
+		}
+		return result
 	}
-	r, err = l.ListByOptions(lo)
-	if err != nil {
-		t.Error(err)
+	byImage := func(op FilterOp, matches ...string) []string {
+		return list(ListOptions{Filters: []Filter{NewFilterOp("spec.containers.image", op, matches...)}})
 	}
-	assert.Len(r, 2)
-	assert.Equal(r[0].(*v1.Pod).Labels["Color"], "red")
-	assert.Equal(r[1].(*v1.Pod).Labels["Color"], "blue")
 
-	// test pagination
-	lo = ListOptions{
-		Filters:    []Filter{},
-		Sort:       Sort{primaryField: []string{"Color"}},
-		Pagination: Pagination{pageSize: 2},
-		Revision:   "",
+	// elements match individually, without substring false matches
+	assert.ElementsMatch([]string{"web", "mesh"}, byImage(FilterEquals, "nginx"))
+	assert.ElementsMatch([]string{"web", "proxy", "mesh"}, byImage(FilterContains, "nginx"))
+	assert.ElementsMatch([]string{"web", "mesh"}, byImage(FilterPrefix, "envoy"))
+	assert.ElementsMatch([]string{}, byImage(FilterEquals, "nginx|envoy"))
+	assert.ElementsMatch([]string{"proxy", "empty"}, byImage(FilterNotEquals, "nginx"))
+	assert.ElementsMatch([]string{"proxy", "mesh"}, byImage(FilterIn, "redis", "nginx-proxy"))
+	assert.ElementsMatch([]string{"web", "empty"}, byImage(FilterNotIn, "redis", "nginx-proxy"))
+	assert.ElementsMatch([]string{"web", "mesh"}, byImage(FilterContainsAll, "envoy", "nginx", "nginx"))
+	assert.ElementsMatch([]string{"mesh"}, byImage(FilterContainsAll, "envoy", "redis"))
+	assert.ElementsMatch([]string{"web", "proxy", "mesh", "empty"}, byImage(FilterContainsAll))
+	assert.ElementsMatch([]string{"empty"}, byImage(FilterNotExists))
+	assert.ElementsMatch([]string{"web", "mesh"}, list(ListOptions{Filters: []Filter{NewFilterOp("Ports", FilterGreaterThan, "8100")}}))
+
+	// objects sort by their lowest element, once each
+	assert.Equal([]string{"empty", "web", "mesh", "proxy"}, list(ListOptions{Sort: NewSort("spec.containers.image", ASC).ThenBy("metadata.name", DESC)}))
+	assert.Equal([]string{"mesh", "proxy", "web", "empty"}, list(ListOptions{Sort: NewSort("Ports", DESC).ThenBy("metadata.name", ASC)}))
+
+	// upserting the same version again replaces all elements
+	assert.NoError(l.Update(pod("mesh", "3", "redis")))
+	assert.ElementsMatch([]string{"web"}, byImage(FilterEquals, "envoy"))
+
+	assert.NoError(l.Close())
+}
+
+func TestListOptionIndexerChunks(t *testing.T) {
+	assert := assert.New(t)
+
+	fieldFuncs := map[string]FieldFunc{
+		"metadata.name": func(c any) any {
+			return c.(*v1.Pod).Name
+		},
+		"Seats": func(c any) any {
+			return c.(*v1.Pod).Labels["Seats"]
+		},
+		"Owner": func(c any) any {
+			owner, ok := c.(*v1.Pod).Labels["Owner"]
+			if !ok {
+				return nil
+			}
+			return owner
+		},
 	}
-	r, err = l.ListByOptions(lo)
-	if err != nil {
-		t.Error(err)
+	l, err := NewListOptionIndexer(&v1.Pod{}, TEST_DB_LOCATION, fieldFuncs,
+		WithFieldTypes(map[string]FieldType{"Seats": IntField}),
+		WithRetentionPolicy(RetentionPolicy{MaxVersionsPerKey: 1}))
+	assert.NoError(err)
+
+	revision := 0
+	pod := func(i int) *v1.Pod {
+		revision++
+		labels := map[string]string{"Seats": strconv.Itoa(i % 7)}
+		if i%3 != 0 {
+			labels["Owner"] = strconv.Itoa(i % 4)
+		}
+		return &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("pod%02d", i), ResourceVersion: strconv.Itoa(revision), Labels: labels}}
 	}
-	assert.Len(r, 2)
-	assert.Equal(r[0].(*v1.Pod).Labels["Color"], "black")
-	assert.Equal(r[1].(*v1.Pod).Labels["Color"], "blue")
-	lo.Pagination.page = 2
-	r, err = l.ListByOptions(lo)
-	if err != nil {
-		t.Error(err)
+	for i := 0; i < 30; i++ {
+		assert.NoError(l.Add(pod(i)))
 	}
-	assert.Len(r, 1)
-	assert.Equal(r[0].(*v1.Pod).Labels["Color"], "red")
 
-	err = l.Close()
-	if err != nil {
-		t.Error(err)
+	names := func(items []any) []string {
+		result := []string{}
+		for _, item := range items {
+			result = append(result, item.(*v1.Pod).Name)
+		}
+		return result
+	}
+	chunk := func(lo ListOptions) ([]string, string) {
+		it, err := l.ListByOptionsIter(context.Background(), lo)
+		assert.NoError(err)
+		items, err := it.collect()
+		assert.NoError(err)
+		token, err := it.Continue()
+		assert.NoError(err)
+		return names(items), token
+	}
+
+	// chunks cover all objects, in order, once
+	for _, sort := range []Sort{
+		{},
+		NewSort("metadata.name", DESC),
+		NewSort("Seats", ASC),
+		NewSort("Seats", DESC).ThenBy("Owner", ASC),
+		NewSort("Owner", DESC).ThenBy("Seats", DESC),
+	} {
+		chunks := []string{}
+		count := 0
+		lo := ListOptions{ChunkSize: 7, Sort: sort, Filters: []Filter{NewFilterOp("Seats", FilterNotEquals, "100")}}
+		for {
+			chunkNames, token := chunk(lo)
+			count++
+			assert.LessOrEqual(len(chunkNames), 7)
+			chunks = append(chunks, chunkNames...)
+			if token == "" {
+				break
+			}
+			lo.Resume = token
+		}
+		assert.Equal(5, count)
+
+		if len(sort.primaryField) == 0 {
+			sort = NewSort("metadata.name", ASC)
+		}
+		if len(sort.secondaryField) == 0 {
+			// keys, equal to names, break ties
+			expected, err := l.ListByOptions(ListOptions{Sort: sort.ThenBy("metadata.name", ASC)})
+			assert.NoError(err)
+			assert.Equal(names(expected), chunks, sort)
+		} else {
+			expected, err := l.ListByOptions(ListOptions{Sort: sort})
+			assert.NoError(err)
+			assert.ElementsMatch(names(expected), chunks, sort)
+		}
+	}
+
+	// chunks are consistent with the revision the listing started at
+	first, token := chunk(ListOptions{ChunkSize: 10})
+	assert.Equal([]string{"pod00", "pod01", "pod02", "pod03", "pod04", "pod05", "pod06", "pod07", "pod08", "pod09"}, first)
+	assert.NoError(l.Delete(pod(15)))
+	assert.NoError(l.Add(pod(10)))
+	assert.NoError(l.Add(pod(35)))
+	second, token := chunk(ListOptions{ChunkSize: 10, Resume: token})
+	assert.Equal([]string{"pod10", "pod11", "pod12", "pod13", "pod14", "pod15", "pod16", "pod17", "pod18", "pod19"}, second)
+	_, err = l.ListByOptions(ListOptions{ChunkSize: 10, Resume: token, Revision: "31"})
+	assert.Error(err)
+
+	// tokens must match the query
+	_, err = l.ListByOptions(ListOptions{Resume: "garbage"})
+	assert.Error(err)
+	_, err = l.ListByOptions(ListOptions{Resume: token, Sort: NewSort("Seats", ASC)})
+	assert.Error(err)
+	assert.Error(l.Validate(ListOptions{ChunkSize: 10, Pagination: NewPagination(10, 1)}))
+
+	// tokens expire when history they need is deleted
+	_, err = l.CollectGarbage(context.Background())
+	assert.NoError(err)
+	_, err = l.ListByOptions(ListOptions{ChunkSize: 10, Resume: token})
+	assert.True(apierrors.IsResourceExpired(err))
+
+	// without ChunkSize, Resume returns all remaining objects
+	all, err := l.ListByOptions(ListOptions{Sort: NewSort("metadata.name", ASC)})
+	assert.NoError(err)
+	_, token = chunk(ListOptions{ChunkSize: 25})
+	rest, token := chunk(ListOptions{Resume: token})
+	assert.Equal(names(all)[25:], rest)
+	assert.Equal("", token)
+
+	assert.NoError(l.Close())
+}
+
+func TestListOptionIndexerListResult(t *testing.T) {
+	assert := assert.New(t)
+
+	l, err := NewListOptionIndexer(&v1.Pod{}, TEST_DB_LOCATION, fieldFunc)
+	assert.NoError(err)
+	for i := 0; i < 20; i++ {
+		color := "red"
+		if i%4 == 0 {
+			color = "blue"
+		}
+		assert.NoError(l.Add(&v1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Name:            fmt.Sprintf("pod%02d", i),
+			ResourceVersion: strconv.Itoa(i + 1),
+			Labels:          map[string]string{"Color": color},
+		}}))
 	}
+	ctx := context.Background()
+	red := []Filter{NewFilterOp("Color", FilterEquals, "red")}
+
+	// pages
+	r, err := l.ListByOptionsResult(ctx, ListOptions{Filters: red, Sort: NewSort("Color", ASC), Pagination: NewPagination(4, 4)})
+	assert.NoError(err)
+	assert.Len(r.Items, 3)
+	assert.Equal(15, r.Total)
+	assert.Equal(4, r.Pages)
+	assert.Equal("20", r.Revision)
+	assert.Equal("", r.Continue)
+
+	// chunks
+	r, err = l.ListByOptionsResult(ctx, ListOptions{Filters: red, ChunkSize: 10})
+	assert.NoError(err)
+	assert.Len(r.Items, 10)
+	assert.Equal(15, r.Total)
+	assert.Equal(2, r.Pages)
+	assert.Equal("20", r.Revision)
+	assert.NotEqual("", r.Continue)
+
+	// later chunks keep counting at the revision the listing started at
+	assert.NoError(l.Add(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod20", ResourceVersion: "21", Labels: map[string]string{"Color": "red"}}}))
+	r, err = l.ListByOptionsResult(ctx, ListOptions{Filters: red, ChunkSize: 10, Resume: r.Continue})
+	assert.NoError(err)
+	assert.Len(r.Items, 5)
+	assert.Equal(15, r.Total)
+	assert.Equal("20", r.Revision)
+	assert.Equal("", r.Continue)
+
+	// latest and past revisions
+	r, err = l.ListByOptionsResult(ctx, ListOptions{Filters: red})
+	assert.NoError(err)
+	assert.Len(r.Items, 16)
+	assert.Equal(16, r.Total)
+	assert.Equal(1, r.Pages)
+	assert.Equal("21", r.Revision)
+	r, err = l.ListByOptionsResult(ctx, ListOptions{Revision: "8"})
+	assert.NoError(err)
+	assert.Equal(8, r.Total)
+	assert.Equal("8", r.Revision)
+
+	// no results
+	r, err = l.ListByOptionsResult(ctx, ListOptions{Filters: []Filter{NewFilterOp("Color", FilterEquals, "green")}, Pagination: NewPagination(10, 1)})
+	assert.NoError(err)
+	assert.Len(r.Items, 0)
+	assert.Equal(0, r.Total)
+	assert.Equal(0, r.Pages)
+
+	_, err = l.ListByOptionsResult(ctx, ListOptions{Filters: []Filter{NewFilter("Model", "f40")}})
+	assert.ErrorIs(err, ErrUnknownField)
+
+	assert.NoError(l.Close())
+}
+
+func TestListOptionIndexerLabelSelector(t *testing.T) {
+	assert := assert.New(t)
+
+	l, err := NewListOptionIndexer(&v1.Pod{}, TEST_DB_LOCATION, fieldFunc)
+	assert.NoError(err)
+	pods := map[string]map[string]string{
+		"testa rossa": {"Brand": "ferrari", "Color": "red", "app.kubernetes.io/tier": "1"},
+		"purosangue":  {"Brand": "ferrari", "Color": "black", "app.kubernetes.io/tier": "2"},
+		"focus":       {"Brand": "ford", "Color": "red", "app.kubernetes.io/tier": "-3"},
+		"model s":     {"Brand": "tesla", "app.kubernetes.io/tier": "x10"},
+		"unlabeled":   nil,
+	}
+	revision := 0
+	for name, labels := range pods {
+		revision++
+		assert.NoError(l.Add(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name, ResourceVersion: strconv.Itoa(revision), Labels: labels}}))
+	}
+
+	tests := []struct {
+		selector string
+		expected []string
+	}{
+		{"", []string{"testa rossa", "purosangue", "focus", "model s", "unlabeled"}},
+		{"Brand=ferrari", []string{"testa rossa", "purosangue"}},
+		{"Brand==ford", []string{"focus"}},
+		{"Brand!=ferrari", []string{"focus", "model s", "unlabeled"}},
+		{"Brand in (ford,tesla)", []string{"focus", "model s"}},
+		{"Color notin (red,blue)", []string{"purosangue", "model s", "unlabeled"}},
+		{"Color", []string{"testa rossa", "purosangue", "focus"}},
+		{"!Color", []string{"model s", "unlabeled"}},
+		{"app.kubernetes.io/tier>0", []string{"testa rossa", "purosangue"}},
+		{"app.kubernetes.io/tier<2", []string{"testa rossa", "focus"}},
+		{"Brand=ferrari,Color=red", []string{"testa rossa"}},
+		{"Brand,Color!=red", []string{"purosangue", "model s"}},
+		{"Brand=fer", []string{}},
+	}
+	for _, test := range tests {
+		selector, err := labels.Parse(test.selector)
+		assert.NoError(err)
+		r, err := l.ListByOptions(ListOptions{LabelSelector: selector})
+		assert.NoError(err, test.selector)
+		names := []string{}
+		for _, item := range r {
+			names = append(names, item.(*v1.Pod).Name)
+		}
+		assert.ElementsMatch(test.expected, names, test.selector)
+	}
+
+	// selectors combine with filters and revisions
+	q, err := url.ParseQuery("labelSelector=Brand%3Dferrari&filter=Color=r&revision=" + strconv.Itoa(revision))
+	assert.NoError(err)
+	lo, err := ParseListOptions(q)
+	assert.NoError(err)
+	assert.Equal(q, lo.Values())
+	assert.NoError(l.Update(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "testa rossa", ResourceVersion: "10", Labels: map[string]string{"Brand": "ferrari"}}}))
+	r, err := l.ListByOptionsResult(context.Background(), lo)
+	assert.NoError(err)
+	assert.Equal(1, r.Total)
+	assert.Equal("testa rossa", r.Items[0].(*v1.Pod).Name)
+	lo.Revision = ""
+	r, err = l.ListByOptionsResult(context.Background(), lo)
+	assert.NoError(err)
+	assert.Equal(0, r.Total)
+
+	r, err = l.ListByOptionsResult(context.Background(), ListOptions{LabelSelector: labels.Nothing()})
+	assert.NoError(err)
+	assert.Equal(0, r.Total)
+	_, err = ParseListOptions(url.Values{"labelSelector": []string{"Brand=="}})
+	assert.NoError(err)
+	_, err = ParseListOptions(url.Values{"labelSelector": []string{"Brand in ferrari"}})
+	assert.Error(err)
+
+	assert.NoError(l.Close())
+}
+
+func TestListOptionIndexerFieldSelector(t *testing.T) {
+	assert := assert.New(t)
+
+	fieldFuncs := map[string]FieldFunc{
+		"metadata.name": func(obj any) any { return obj.(*v1.Pod).Name },
+		"spec.nodeName": func(obj any) any { return obj.(*v1.Pod).Spec.NodeName },
+		"status.phase": func(obj any) any {
+			if obj.(*v1.Pod).Status.Phase == "" {
+				return nil
+			}
+			return string(obj.(*v1.Pod).Status.Phase)
+		},
+		"spec.priority": func(obj any) any {
+			if obj.(*v1.Pod).Spec.Priority == nil {
+				return nil
+			}
+			return int(*obj.(*v1.Pod).Spec.Priority)
+		},
+	}
+	l, err := NewListOptionIndexer(&v1.Pod{}, TEST_DB_LOCATION, fieldFuncs, WithFieldTypes(map[string]FieldType{"spec.priority": IntField}))
+	assert.NoError(err)
+	priority := int32(10)
+	pods := []*v1.Pod{
+		{ObjectMeta: metav1.ObjectMeta{Name: "a", ResourceVersion: "1"}, Spec: v1.PodSpec{NodeName: "node1", Priority: &priority}, Status: v1.PodStatus{Phase: v1.PodRunning}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "b", ResourceVersion: "2"}, Spec: v1.PodSpec{NodeName: "node1"}, Status: v1.PodStatus{Phase: v1.PodPending}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "c", ResourceVersion: "3"}, Spec: v1.PodSpec{NodeName: "node2"}, Status: v1.PodStatus{Phase: v1.PodRunning}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "d", ResourceVersion: "4"}},
+	}
+	for _, pod := range pods {
+		assert.NoError(l.Add(pod))
+	}
+
+	tests := []struct {
+		selector string
+		expected []string
+	}{
+		{"", []string{"a", "b", "c", "d"}},
+		{"spec.nodeName=node1", []string{"a", "b"}},
+		{"spec.nodeName==node2", []string{"c"}},
+		{"spec.nodeName=node", []string{}},
+		{"spec.nodeName=node1,status.phase!=Running", []string{"b"}},
+		{"status.phase!=Running", []string{"b", "d"}},
+		{"spec.nodeName=", []string{"d"}},
+		{"spec.nodeName!=", []string{"a", "b", "c"}},
+		{"status.phase=", []string{"d"}},
+		{"spec.priority=10", []string{"a"}},
+		{"spec.priority!=10", []string{"b", "c", "d"}},
+		{"spec.priority=", []string{"b", "c", "d"}},
+		{"spec.priority!=", []string{"a"}},
+	}
+	for _, test := range tests {
+		selector, err := fields.ParseSelector(test.selector)
+		assert.NoError(err)
+		r, err := l.ListByOptions(ListOptions{FieldSelector: selector})
+		assert.NoError(err, test.selector)
+		names := []string{}
+		for _, item := range r {
+			names = append(names, item.(*v1.Pod).Name)
+		}
+		assert.ElementsMatch(test.expected, names, test.selector)
+	}
+
+	// selectors combine with filters and are parsed from query strings
+	q, err := url.ParseQuery("fieldSelector=spec.nodeName%3Dnode1&filter=metadata.name!=a")
+	assert.NoError(err)
+	lo, err := ParseListOptions(q)
+	assert.NoError(err)
+	assert.Equal(q, lo.Values())
+	r, err := l.ListByOptionsResult(context.Background(), lo)
+	assert.NoError(err)
+	assert.Equal(1, r.Total)
+	assert.Equal("b", r.Items[0].(*v1.Pod).Name)
+
+	// unsupported fields and invalid values are reported
+	_, err = l.ListByOptions(ListOptions{FieldSelector: fields.OneTermEqualSelector("spec.hostname", "x")})
+	assert.ErrorIs(err, ErrUnknownField)
+	assert.ErrorContains(err, "spec.hostname")
+	assert.ErrorIs(l.Validate(ListOptions{FieldSelector: fields.OneTermNotEqualSelector("spec.hostname", "x")}), ErrUnknownField)
+	assert.Error(l.Validate(ListOptions{FieldSelector: fields.OneTermEqualSelector("spec.priority", "high")}))
+	_, err = ParseListOptions(url.Values{"fieldSelector": []string{"spec.nodeName"}})
+	assert.Error(err)
+
+	assert.NoError(l.Close())
+}
+
+func TestListOptionIndexerNamespaces(t *testing.T) {
+	assert := assert.New(t)
+
+	l, err := NewListOptionIndexer(&v1.Pod{}, TEST_DB_LOCATION, fieldFunc)
+	assert.NoError(err)
+	pods := []*v1.Pod{
+		{ObjectMeta: metav1.ObjectMeta{Name: "testa rossa", Namespace: "italy", ResourceVersion: "1", Labels: map[string]string{"Brand": "ferrari"}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "testa rossa", Namespace: "germany", ResourceVersion: "2", Labels: map[string]string{"Brand": "ferrari"}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "focus", Namespace: "germany", ResourceVersion: "3", Labels: map[string]string{"Brand": "ford"}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "model s", Namespace: "usa", ResourceVersion: "4", Labels: map[string]string{"Brand": "tesla"}}},
+	}
+	for _, pod := range pods {
+		assert.NoError(l.Add(pod))
+	}
+
+	// same names in different namespaces do not collide
+	assert.ElementsMatch([]string{"italy/testa rossa", "germany/testa rossa", "germany/focus", "usa/model s"}, l.ListKeys())
+	item, exists, err := l.GetByKey("germany/testa rossa")
+	assert.NoError(err)
+	assert.True(exists)
+	assert.Equal("2", item.(*v1.Pod).ResourceVersion)
+
+	list := func(lo ListOptions) []string {
+		r, err := l.ListByOptions(lo)
+		assert.NoError(err)
+		keys := []string{}
+		for _, item := range r {
+			keys = append(keys, item.(*v1.Pod).Namespace+"/"+item.(*v1.Pod).Name)
+		}
+		return keys
+	}
+	assert.ElementsMatch([]string{"italy/testa rossa", "germany/testa rossa", "germany/focus", "usa/model s"}, list(ListOptions{}))
+	assert.ElementsMatch([]string{"germany/testa rossa", "germany/focus"}, list(ListOptions{Namespaces: []string{"germany"}}))
+	assert.ElementsMatch([]string{"italy/testa rossa", "usa/model s"}, list(ListOptions{Namespaces: []string{"italy", "usa"}}))
+	assert.ElementsMatch([]string{}, list(ListOptions{Namespaces: []string{"france"}}))
+	assert.ElementsMatch([]string{"germany/testa rossa"}, list(ListOptions{Namespaces: []string{"germany"}, Filters: []Filter{NewFilter("Brand", "ferrari")}}))
+
+	// metadata.name and metadata.namespace field selectors work without FieldFuncs, as in the Kubernetes API
+	selector := func(s string) fields.Selector {
+		result, err := fields.ParseSelector(s)
+		assert.NoError(err)
+		return result
+	}
+	assert.ElementsMatch([]string{"germany/testa rossa", "germany/focus"}, list(ListOptions{FieldSelector: selector("metadata.namespace=germany")}))
+	assert.ElementsMatch([]string{"italy/testa rossa", "germany/testa rossa"}, list(ListOptions{FieldSelector: selector("metadata.name==testa rossa")}))
+	assert.ElementsMatch([]string{"italy/testa rossa", "usa/model s"}, list(ListOptions{FieldSelector: selector("metadata.namespace!=germany")}))
+	assert.ElementsMatch([]string{"germany/focus"}, list(ListOptions{FieldSelector: selector("metadata.namespace=germany,metadata.name!=testa rossa")}))
+	assert.ElementsMatch([]string{}, list(ListOptions{FieldSelector: selector("metadata.namespace=")}))
+	assert.NoError(l.Validate(ListOptions{FieldSelector: selector("metadata.name=focus")}))
+
+	// deletions, including of final states unknown, only affect their namespace
+	assert.NoError(l.Delete(cache.DeletedFinalStateUnknown{Key: "italy/testa rossa", Obj: pods[0]}))
+	assert.ElementsMatch([]string{"germany/testa rossa"}, list(ListOptions{Filters: []Filter{NewFilter("Brand", "ferrari")}}))
+	assert.ElementsMatch([]string{"italy/testa rossa"}, list(ListOptions{Namespaces: []string{"italy"}, Revision: "3"}))
+
+	// namespaces are parsed from query strings and validated
+	q, err := url.ParseQuery("namespace=germany,usa&sort=metadata.name")
+	assert.NoError(err)
+	lo, err := ParseListOptions(q)
+	assert.NoError(err)
+	assert.Equal([]string{"germany", "usa"}, lo.Namespaces)
+	assert.Equal(q, lo.Values())
+	r, err := l.ListByOptionsResult(context.Background(), ListOptions{Namespaces: lo.Namespaces})
+	assert.NoError(err)
+	assert.Equal(3, r.Total)
+	assert.Error(l.Validate(ListOptions{Namespaces: []string{"germany", ""}}))
+
+	assert.NoError(l.Close())
+
+	// cluster-scoped objects are keyed by name and have no namespace
+	n, err := NewListOptionIndexer(&v1.Namespace{}, TEST_DB_LOCATION, map[string]FieldFunc{})
+	assert.NoError(err)
+	assert.NoError(n.Add(&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "germany", ResourceVersion: "1"}}))
+	assert.Equal([]string{"germany"}, n.ListKeys())
+	r, err = n.ListByOptionsResult(context.Background(), ListOptions{})
+	assert.NoError(err)
+	assert.Equal(1, r.Total)
+	r, err = n.ListByOptionsResult(context.Background(), ListOptions{Namespaces: []string{"germany"}})
+	assert.NoError(err)
+	assert.Equal(0, r.Total)
+	r, err = n.ListByOptionsResult(context.Background(), ListOptions{FieldSelector: fields.ParseSelectorOrDie("metadata.namespace=,metadata.name=germany")})
+	assert.NoError(err)
+	assert.Equal(1, r.Total)
+	assert.NoError(n.Close())
+}
+
+func TestListOptionIndexerInMemoryChunks(t *testing.T) {
+	assert := assert.New(t)
+
+	l, err := NewListOptionIndexer(&v1.Pod{}, TEST_DB_LOCATION, fieldFunc, WithProfile(InMemoryProfile))
+	assert.NoError(err)
+	for i := 0; i < 5; i++ {
+		assert.NoError(l.Add(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("pod%d", i), ResourceVersion: strconv.Itoa(i + 1),
+			Labels: map[string]string{"Brand": fmt.Sprintf("brand%d", i%2)}}}))
+	}
+
+	// chunks are listed without waiting for the only connection, which is held by the read transaction
+	done := make(chan any)
+	go func() {
+		defer close(done)
+		lo := ListOptions{ChunkSize: 2, Sort: NewSort("Brand", ASC)}
+		names := []string{}
+		for {
+			r, err := l.ListByOptionsResult(context.Background(), lo)
+			assert.NoError(err)
+			assert.Equal(5, r.Total)
+			for _, item := range r.Items {
+				names = append(names, item.(*v1.Pod).Name)
+			}
+			if r.Continue == "" {
+				break
+			}
+			lo.Resume = r.Continue
+		}
+		assert.Equal([]string{"pod0", "pod2", "pod4", "pod1", "pod3"}, names)
+
+		it, err := l.ListByOptionsIter(context.Background(), ListOptions{ChunkSize: 2, Resume: lo.Resume, Sort: lo.Sort})
+		assert.NoError(err)
+		r, err := it.collect()
+		assert.NoError(err)
+		assert.Len(r, 1)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("chunked listing blocked")
+	}
+
+	assert.NoError(l.Close())
 }
@@ -0,0 +1,73 @@
+package sqlcache
+
+import (
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+	"sync"
+)
+
+// resumingListerWatcher is a cache.ListerWatcher that answers the first List call from a ListOptionIndexer
+type resumingListerWatcher struct {
+	cache.ListerWatcher
+	indexer *ListOptionIndexer
+
+	lock    sync.Mutex
+	resumed bool
+}
+
+// NewResumingListerWatcher wraps lw so that a Reflector feeding l can resume from data persisted by a previous run
+// (see WithReopen). If l has a last synced resourceVersion, the first List call is answered from l itself at that
+// resourceVersion, so that the Reflector starts WATCHing from there instead of LISTing from the API server.
+// All subsequent calls, including List calls after a watch expired, are delegated to lw
+func NewResumingListerWatcher(lw cache.ListerWatcher, l *ListOptionIndexer) cache.ListerWatcher {
+	return &resumingListerWatcher{
+		ListerWatcher: lw,
+		indexer:       l,
+	}
+}
+
+// List returns the persisted contents of the ListOptionIndexer on the first call, then delegates
+func (r *resumingListerWatcher) List(options metav1.ListOptions) (runtime.Object, error) {
+	r.lock.Lock()
+	resumed := r.resumed
+	r.resumed = true
+	r.lock.Unlock()
+
+	if resumed {
+		return r.ListerWatcher.List(options)
+	}
+
+	resourceVersion, err := r.indexer.LastResourceVersion()
+	if err != nil {
+		return nil, err
+	}
+	if resourceVersion == "" {
+		return r.ListerWatcher.List(options)
+	}
+
+	objects, err := r.indexer.QueryObjects(r.indexer.listStmt)
+	if err != nil {
+		return nil, err
+	}
+	items := make([]runtime.RawExtension, 0, len(objects))
+	for _, object := range objects {
+		o, ok := object.(runtime.Object)
+		if !ok {
+			return nil, errors.Errorf("Unexpected object does not conform to runtime.Object: %v", object)
+		}
+		items = append(items, runtime.RawExtension{Object: o})
+	}
+
+	return &metav1.List{
+		ListMeta: metav1.ListMeta{ResourceVersion: resourceVersion},
+		Items:    items,
+	}, nil
+}
+
+// Watch delegates to the wrapped ListerWatcher
+func (r *resumingListerWatcher) Watch(options metav1.ListOptions) (watch.Interface, error) {
+	return r.ListerWatcher.Watch(options)
+}
@@ -0,0 +1,77 @@
+package sqlcache
+
+import (
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/cache"
+	"testing"
+)
+
+func TestResumingListerWatcher(t *testing.T) {
+	assert := assert.New(t)
+
+	l, err := NewListOptionIndexer(&v1.Pod{}, TEST_DB_LOCATION, fieldFunc)
+	if err != nil {
+		t.Error(err)
+	}
+	err = l.Replace([]any{
+		&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "a", ResourceVersion: "3"}},
+		&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "b", ResourceVersion: "5"}},
+	}, "10")
+	if err != nil {
+		t.Error(err)
+	}
+	rv, err := l.LastResourceVersion()
+	assert.NoError(err)
+	assert.Equal("10", rv)
+
+	// upserts bump the last resourceVersion, but never lower it
+	err = l.Add(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "c", ResourceVersion: "12"}})
+	assert.NoError(err)
+	err = l.Add(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "d", ResourceVersion: "11"}})
+	assert.NoError(err)
+	err = l.Close()
+	assert.NoError(err)
+
+	// the last resourceVersion survives reopening
+	l, err = NewListOptionIndexer(&v1.Pod{}, TEST_DB_LOCATION, fieldFunc, WithReopen())
+	if err != nil {
+		t.Error(err)
+	}
+	rv, err = l.LastResourceVersion()
+	assert.NoError(err)
+	assert.Equal("12", rv)
+
+	// first List comes from the indexer, subsequent ones from the wrapped ListerWatcher
+	listCalls := 0
+	lw := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			listCalls++
+			return &v1.PodList{ListMeta: metav1.ListMeta{ResourceVersion: "20"}}, nil
+		},
+	}
+	rlw := NewResumingListerWatcher(lw, l)
+
+	list, err := rlw.List(metav1.ListOptions{})
+	assert.NoError(err)
+	assert.Equal(0, listCalls)
+	listMeta, err := meta.ListAccessor(list)
+	assert.NoError(err)
+	assert.Equal("12", listMeta.GetResourceVersion())
+	items, err := meta.ExtractList(list)
+	assert.NoError(err)
+	assert.Len(items, 4)
+
+	list, err = rlw.List(metav1.ListOptions{})
+	assert.NoError(err)
+	assert.Equal(1, listCalls)
+	listMeta, err = meta.ListAccessor(list)
+	assert.NoError(err)
+	assert.Equal("20", listMeta.GetResourceVersion())
+
+	err = l.Close()
+	assert.NoError(err)
+}
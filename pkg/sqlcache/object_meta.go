@@ -0,0 +1,52 @@
+package sqlcache
+
+import (
+	"database/sql"
+	"github.com/pkg/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"strings"
+)
+
+// objectMetaColumns maps fields supported by field selectors on all resources, as in the Kubernetes API, to their
+// columns in the object_meta table
+var objectMetaColumns = map[string]string{
+	"metadata.name":      "name",
+	"metadata.namespace": "namespace",
+}
+
+// objectMetaMatchClause matches the object_meta row of the object_history row o
+const objectMetaMatchClause = "m.key = o.key AND m.version = o.version"
+
+// afterObjectMetaUpsert saves the namespace and name of obj, at version, into the object_meta table as part of tx.
+// Cluster-scoped objects have an empty namespace
+func (l *ListOptionIndexer) afterObjectMetaUpsert(key string, version int, obj any, tx *sql.Tx) error {
+	o, ok := obj.(meta.Object)
+	if !ok {
+		return errors.Errorf("Unexpected object does not conform to meta.Object: %v", obj)
+	}
+	_, err := tx.Stmt(l.upsertObjectMetaStmt).Exec(key, version, o.GetNamespace(), o.GetName())
+	return err
+}
+
+// namespacesClause returns a WHERE clause matching objects in any of namespaces, with its parameters
+func namespacesClause(namespaces []string) (string, []any) {
+	if len(namespaces) == 0 {
+		return "", nil
+	}
+	params := []any{}
+	for _, namespace := range namespaces {
+		params = append(params, namespace)
+	}
+	placeholders := strings.TrimPrefix(strings.Repeat(", ?", len(namespaces)), ", ")
+	return "EXISTS (SELECT 1 FROM object_meta m WHERE " + objectMetaMatchClause + " AND m.namespace IN (" + placeholders + "))", params
+}
+
+// objectMetaClause returns a WHERE clause matching objects whose field, as in objectMetaColumns, is (or, if negated,
+// is not) value
+func objectMetaClause(field string, value string, negated bool) (string, []any) {
+	clause := "EXISTS (SELECT 1 FROM object_meta m WHERE " + objectMetaMatchClause + " AND m." + objectMetaColumns[field] + " = ?)"
+	if negated {
+		clause = "NOT " + clause
+	}
+	return clause, []any{value}
+}
@@ -0,0 +1,142 @@
+package sqlcache
+
+import "time"
+
+// Option customizes a Store and all the types that build upon it (Indexer, VersionedIndexer, ListOptionIndexer...)
+type Option func(*options)
+
+// options collects all settings that can be altered via Option
+type options struct {
+	reopen            bool
+	codec             Codec
+	compression       Compression
+	dictionarySamples int
+	errorHandler      ErrorHandler
+
+	coalescingInterval  time.Duration
+	coalescingMaxWrites int
+
+	profile   Profile
+	pageSize  int
+	cacheSize int
+	mmapSize  int64
+	tempStore TempStore
+
+	retentionPolicy *RetentionPolicy
+	fieldTypes      map[string]FieldType
+}
+
+// WithReopen makes constructors reuse the database already existing at path, if any, instead of wiping it.
+// The existing database is validated against the schema and stored type, an error is returned on mismatch
+func WithReopen() Option {
+	return func(o *options) {
+		o.reopen = true
+	}
+}
+
+// WithCodec makes the Store encode objects with codec instead of the default GobCodec
+func WithCodec(codec Codec) Option {
+	return func(o *options) {
+		o.codec = codec
+	}
+}
+
+// WithCompression makes the Store compress encoded objects with the given algorithm.
+// Rows written with different (or no) compression settings can coexist in the same database
+func WithCompression(compression Compression) Option {
+	return func(o *options) {
+		o.compression = compression
+	}
+}
+
+// WithZstdDictionary makes the Store train a shared dictionary from the first samples encoded objects, then use it
+// to compress all subsequent ones. Only meaningful with ZstdCompression. The dictionary is persisted in the database
+func WithZstdDictionary(samples int) Option {
+	return func(o *options) {
+		o.dictionarySamples = samples
+	}
+}
+
+// WithErrorHandler sets the ErrorHandler called on errors in methods whose signature does not allow returning them,
+// instead of the default PanicOnError
+func WithErrorHandler(errorHandler ErrorHandler) Option {
+	return func(o *options) {
+		o.errorHandler = errorHandler
+	}
+}
+
+// WithWriteCoalescing makes the Store queue upserts and deletions, then write them in a single transaction
+// at most interval after the first queued one, as soon as maxWrites are queued, or before any read.
+// Each queued operation is applied independently, so that an error in one does not discard others. Errors are
+// returned by the operation itself if it triggered the write, otherwise handled via the ErrorHandler in the
+// background, so that they never reach unrelated operations. Zero values disable the corresponding trigger
+func WithWriteCoalescing(interval time.Duration, maxWrites int) Option {
+	return func(o *options) {
+		o.coalescingInterval = interval
+		o.coalescingMaxWrites = maxWrites
+	}
+}
+
+// WithProfile selects a set of SQLite settings instead of the default EphemeralProfile
+func WithProfile(profile Profile) Option {
+	return func(o *options) {
+		o.profile = profile
+	}
+}
+
+// WithPageSize sets the database page size in bytes, a power of two between 512 and 65536.
+// It only has effect on newly created databases
+func WithPageSize(bytes int) Option {
+	return func(o *options) {
+		o.pageSize = bytes
+	}
+}
+
+// WithCacheSize sets the maximum size of the page cache of each connection, in KiB
+func WithCacheSize(kibibytes int) Option {
+	return func(o *options) {
+		o.cacheSize = kibibytes
+	}
+}
+
+// WithMmapSize makes connections access up to bytes of the database file via memory mapping
+func WithMmapSize(bytes int64) Option {
+	return func(o *options) {
+		o.mmapSize = bytes
+	}
+}
+
+// WithTempStore sets where temporary tables and indices are kept
+func WithTempStore(tempStore TempStore) Option {
+	return func(o *options) {
+		o.tempStore = tempStore
+	}
+}
+
+// WithRetentionPolicy makes a VersionedIndexer (or ListOptionIndexer) delete past versions according to policy,
+// periodically if policy.Interval is set, or when CollectGarbage is called. It has no effect on other types
+func WithRetentionPolicy(policy RetentionPolicy) Option {
+	return func(o *options) {
+		o.retentionPolicy = &policy
+	}
+}
+
+// WithFieldTypes declares the types of a ListOptionIndexer's fields, by name. Fields without a declared type are
+// StringFields. It has no effect on other types
+func WithFieldTypes(types map[string]FieldType) Option {
+	return func(o *options) {
+		o.fieldTypes = types
+	}
+}
+
+// buildOptions applies opts on top of defaults
+func buildOptions(opts []Option) options {
+	result := options{
+		codec:        GobCodec{},
+		errorHandler: PanicOnError,
+	}
+	for _, opt := range opts {
+		opt(&result)
+	}
+	return result
+}
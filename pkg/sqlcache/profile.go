@@ -0,0 +1,134 @@
+package sqlcache
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"github.com/mattn/go-sqlite3"
+	"runtime"
+	"sync/atomic"
+)
+
+// Profile is a named set of SQLite settings trading memory and speed for durability
+type Profile int
+
+const (
+	// EphemeralProfile keeps the database on disk in WAL mode, without waiting for data to reach the disk.
+	// Fast, but the database might be corrupted by an OS crash or power loss. Suitable for caches that are
+	// rebuilt from scratch at startup
+	EphemeralProfile Profile = iota
+	// PersistentProfile keeps the database on disk in WAL mode, waiting for each transaction to reach the disk.
+	// Slower, but survives crashes and power losses. Suitable for use with WithReopen
+	PersistentProfile
+	// InMemoryProfile keeps the database in memory only, path is ignored. Fastest, but contents are lost on Close.
+	// As with other profiles, reads run on their own connections in parallel with writes, but they are not isolated
+	// from them: they can observe writes of transactions in progress, including objects written during iteration
+	InMemoryProfile
+)
+
+// TempStore determines where SQLite keeps temporary tables and indices, eg. those built for sorting
+type TempStore int
+
+const (
+	// DefaultTempStore uses SQLite's compile-time default
+	DefaultTempStore TempStore = iota
+	// FileTempStore keeps temporary data in files
+	FileTempStore
+	// MemoryTempStore keeps temporary data in memory
+	MemoryTempStore
+)
+
+// inMemoryDatabases counts databases created with InMemoryProfile, to name them uniquely
+var inMemoryDatabases atomic.Int64
+
+// openDBs returns the writer and reader pools for the database at path according to o.
+// Connections are opened lazily, so readers only connect after the writer has created the database
+func openDBs(path string, o options) (db *sql.DB, readDB *sql.DB) {
+	if o.profile == InMemoryProfile {
+		// connections share a uniquely named database, which is kept alive by the idle writer connection. Readers
+		// do not take table locks, which would make writes fail with SQLITE_LOCKED in shared-cache mode
+		name := fmt.Sprintf("file:sqlcache-%d?mode=memory&cache=shared", inMemoryDatabases.Add(1))
+		db = openDB(name+"&_txlock=immediate&_mutex=no&_foreign_keys=on", writerPragmas(o))
+		db.SetMaxOpenConns(1)
+		db.SetMaxIdleConns(1)
+		readDB = openDB(name+"&_mutex=no", append(connectionPragmas(o), "PRAGMA read_uncommitted = ON", "PRAGMA query_only = ON"))
+		readDB.SetMaxIdleConns(runtime.NumCPU())
+		return db, readDB
+	}
+
+	// _mutex=no is safe as database/sql never uses a connection from more than one goroutine at a time
+	db = openDB(path+"?mode=rwc&_busy_timeout=5000&_txlock=immediate&_mutex=no&_foreign_keys=on", writerPragmas(o))
+	db.SetMaxOpenConns(1)
+	readDB = openDB(path+"?mode=ro&_busy_timeout=5000&_mutex=no", connectionPragmas(o))
+	readDB.SetMaxIdleConns(runtime.NumCPU())
+	return db, readDB
+}
+
+// writerPragmas returns statements to configure the writer connection, including settings stored in the database
+func writerPragmas(o options) []string {
+	var result []string
+	// page size can only be changed before the database is created in WAL mode
+	if o.pageSize > 0 {
+		result = append(result, fmt.Sprintf("PRAGMA page_size = %d", o.pageSize))
+	}
+	switch o.profile {
+	case EphemeralProfile:
+		result = append(result, "PRAGMA journal_mode = WAL", "PRAGMA synchronous = OFF")
+	case PersistentProfile:
+		result = append(result, "PRAGMA journal_mode = WAL", "PRAGMA synchronous = FULL")
+	case InMemoryProfile:
+		result = append(result, "PRAGMA journal_mode = MEMORY", "PRAGMA synchronous = OFF")
+	}
+	return append(result, connectionPragmas(o)...)
+}
+
+// connectionPragmas returns statements to configure any connection
+func connectionPragmas(o options) []string {
+	var result []string
+	if o.cacheSize != 0 {
+		// negative values are in KiB
+		result = append(result, fmt.Sprintf("PRAGMA cache_size = %d", -o.cacheSize))
+	}
+	if o.mmapSize > 0 {
+		result = append(result, fmt.Sprintf("PRAGMA mmap_size = %d", o.mmapSize))
+	}
+	if o.tempStore != DefaultTempStore {
+		result = append(result, fmt.Sprintf("PRAGMA temp_store = %d", o.tempStore))
+	}
+	return result
+}
+
+// openDB returns a pool of connections to dsn, each configured with pragmas
+func openDB(dsn string, pragmas []string) *sql.DB {
+	return sql.OpenDB(&connector{
+		dsn: dsn,
+		driver: &sqlite3.SQLiteDriver{
+			ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+				for _, pragma := range pragmas {
+					_, err := conn.Exec(pragma, nil)
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		},
+	})
+}
+
+// connector is a driver.Connector opening connections to dsn with driver
+type connector struct {
+	dsn    string
+	driver *sqlite3.SQLiteDriver
+}
+
+// Connect opens a new connection
+func (c *connector) Connect(context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.dsn)
+}
+
+// Driver returns the underlying driver
+func (c *connector) Driver() driver.Driver {
+	return c.driver
+}
@@ -0,0 +1,138 @@
+package sqlcache
+
+import (
+	"context"
+	"database/sql"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestProfiles(t *testing.T) {
+	cases := map[string]struct {
+		profile     Profile
+		journalMode string
+		synchronous int
+	}{
+		"ephemeral":  {EphemeralProfile, "wal", 0},
+		"persistent": {PersistentProfile, "wal", 2},
+		"in-memory":  {InMemoryProfile, "memory", 0},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			assert.NoError(removeDatabase(TEST_DB_LOCATION))
+
+			store, err := NewIndexer(testStoreObject{}, testStoreKeyFunc, TEST_DB_LOCATION, testStoreIndexers(), WithProfile(c.profile))
+			assert.NoError(err)
+
+			var journalMode string
+			assert.NoError(store.db.QueryRow(`PRAGMA journal_mode`).Scan(&journalMode))
+			assert.Equal(c.journalMode, journalMode)
+			var synchronous int
+			assert.NoError(store.db.QueryRow(`PRAGMA synchronous`).Scan(&synchronous))
+			assert.Equal(c.synchronous, synchronous)
+
+			_, err = os.Stat(TEST_DB_LOCATION)
+			assert.Equal(c.profile == InMemoryProfile, os.IsNotExist(err))
+
+			assert.NoError(store.Add(testStoreObject{Id: "a", Val: "b"}))
+			assert.NoError(store.Add(testStoreObject{Id: "c", Val: "d"}))
+			assert.NoError(store.Delete(testStoreObject{Id: "c"}))
+			item, exists, err := store.GetByKey("a")
+			assert.NoError(err)
+			assert.True(exists)
+			assert.Equal(testStoreObject{Id: "a", Val: "b"}, item)
+			keys, err := store.IndexKeys("by_val", "b")
+			assert.NoError(err)
+			assert.Equal([]string{"a"}, keys)
+			assert.NoError(store.Replace([]any{testStoreObject{Id: "e", Val: "f"}}, ""))
+			assert.Equal([]string{"e"}, store.ListKeys())
+
+			assert.NoError(store.Close())
+		})
+	}
+}
+
+func TestInMemoryProfileIteration(t *testing.T) {
+	assert := assert.New(t)
+
+	store, err := NewIndexer(testStoreObject{}, testStoreKeyFunc, TEST_DB_LOCATION, testStoreIndexers(), WithProfile(InMemoryProfile))
+	assert.NoError(err)
+	for _, id := range []string{"a", "b", "c"} {
+		assert.NoError(store.Add(testStoreObject{Id: id, Val: id}))
+	}
+
+	// databases of different Stores are separate
+	other, err := NewStore(testStoreObject{}, testStoreKeyFunc, TEST_DB_LOCATION, WithProfile(InMemoryProfile))
+	assert.NoError(err)
+	assert.Empty(other.ListKeys())
+	assert.NoError(other.Close())
+
+	// iterators stream results on reader connections, while other reads and writes proceed
+	done := make(chan any)
+	go func() {
+		defer close(done)
+		it, err := store.ListIter(context.Background())
+		assert.NoError(err)
+		ids := []string{}
+		assert.NoError(it.ForEach(func(obj any) error {
+			id := obj.(testStoreObject).Id
+			ids = append(ids, id)
+			item, exists, err := store.GetByKey(id)
+			assert.NoError(err)
+			assert.True(exists)
+			assert.Equal(obj, item)
+			if len(id) > 1 {
+				// objects written during iteration might be returned as well
+				return nil
+			}
+			return store.Add(testStoreObject{Id: id + "2", Val: id})
+		}))
+		assert.Subset(ids, []string{"a", "b", "c"})
+
+		// reads do not wait for open Batches either
+		b, err := store.Begin()
+		assert.NoError(err)
+		assert.NoError(b.Upsert("d", testStoreObject{Id: "d", Val: "d"}))
+		_, exists, err := store.GetByKey("a")
+		assert.NoError(err)
+		assert.True(exists)
+		assert.NoError(b.Commit())
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("iteration or a Batch blocked other reads and writes")
+	}
+	assert.ElementsMatch([]string{"a", "b", "c", "a2", "b2", "c2", "d"}, store.ListKeys())
+
+	assert.NoError(store.Close())
+}
+
+func TestStorageSettings(t *testing.T) {
+	assert := assert.New(t)
+
+	store, err := NewStore(testStoreObject{}, testStoreKeyFunc, TEST_DB_LOCATION,
+		WithPageSize(8192), WithCacheSize(4096), WithMmapSize(1<<20), WithTempStore(MemoryTempStore))
+	assert.NoError(err)
+	assert.NoError(store.Add(testStoreObject{Id: "a", Val: "b"}))
+
+	var pageSize int
+	assert.NoError(store.db.QueryRow(`PRAGMA page_size`).Scan(&pageSize))
+	assert.Equal(8192, pageSize)
+
+	// per-connection settings apply to readers as well
+	for _, db := range []*sql.DB{store.db, store.readDB} {
+		var cacheSize, mmapSize, tempStore int
+		assert.NoError(db.QueryRow(`PRAGMA cache_size`).Scan(&cacheSize))
+		assert.Equal(-4096, cacheSize)
+		assert.NoError(db.QueryRow(`PRAGMA mmap_size`).Scan(&mmapSize))
+		assert.Equal(1<<20, mmapSize)
+		assert.NoError(db.QueryRow(`PRAGMA temp_store`).Scan(&tempStore))
+		assert.Equal(int(MemoryTempStore), tempStore)
+	}
+
+	assert.NoError(store.Close())
+}
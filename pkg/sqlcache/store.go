@@ -1,52 +1,108 @@
 package sqlcache
 
 import (
-	"bytes"
+	"context"
 	"database/sql"
-	"encoding/gob"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/pkg/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
 	"os"
 	"reflect"
+	"sort"
+	"strings"
 )
 
-// Store is a SQLite-backed cache.Store
-type Store struct {
-	typ     reflect.Type
-	keyFunc cache.KeyFunc
-
-	db           *sql.DB
-	upsertStmt   *sql.Stmt
-	deleteStmt   *sql.Stmt
-	getStmt      *sql.Stmt
-	listStmt     *sql.Stmt
-	listKeysStmt *sql.Stmt
+// schemaVersion identifies the layout of tables created by this package. It is checked when reopening databases
+const schemaVersion = "9"
 
-	afterUpsert []func(key string, obj any, tx *sql.Tx) error
-	afterDelete []func(key string, tx *sql.Tx) error
+// Store is a SQLite-backed cache.Store.
+//
+// Store is safe for concurrent use. The database is kept in WAL mode and accessed via two connection pools: writes
+// are serialized through a single writer connection, while reads run in parallel on read-only connections and never
+// block on, or are blocked by, writes. Reads observe all writes committed before they start, and with InMemoryProfile
+// also writes in progress.
+// Functions registered via Register... run in the writer's transaction and must only access the database through it
+type Store struct {
+	typ          reflect.Type
+	keyFunc      cache.KeyFunc
+	codec        Codec
+	compressor   *compressor
+	errorHandler ErrorHandler
+	coalescer    *coalescer
+
+	// db is the writer pool, limited to one connection
+	db               *sql.DB
+	upsertStmt       *sql.Stmt
+	deleteStmt       *sql.Stmt
+	listKeysInTxStmt *sql.Stmt
+	getInTxStmt      *sql.Stmt
+	setMetadataStmt  *sql.Stmt
+
+	// readDB is the read-only pool
+	readDB          *sql.DB
+	getStmt         *sql.Stmt
+	listStmt        *sql.Stmt
+	listKeysStmt    *sql.Stmt
+	getMetadataStmt *sql.Stmt
+
+	afterUpsert  []func(key string, obj any, tx *sql.Tx) error
+	afterDelete  []func(key string, obj any, resourceVersion string, tx *sql.Tx) error
+	afterReplace []func(resourceVersion string, tx *sql.Tx) error
+	isUnchanged  []func(key string, obj any, tx *sql.Tx) (bool, error)
+	afterCommit  []func()
 }
 
-// NewStore creates a SQLite-backed cache.Store for objects of the given example type
-func NewStore(example any, keyFunc cache.KeyFunc, path string) (*Store, error) {
-	err := os.RemoveAll(path)
+// NewStore creates a SQLite-backed cache.Store for objects of the given example type.
+// Any existing database at path is wiped, unless WithReopen is specified
+func NewStore(example any, keyFunc cache.KeyFunc, path string, opts ...Option) (*Store, error) {
+	o := buildOptions(opts)
+	if !o.reopen && o.profile != InMemoryProfile {
+		err := removeDatabase(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	db, readDB := openDBs(path, o)
+
+	s := &Store{
+		typ:          reflect.TypeOf(example),
+		keyFunc:      keyFunc,
+		codec:        o.codec,
+		errorHandler: o.errorHandler,
+		db:           db,
+		readDB:       readDB,
+		afterUpsert:  []func(key string, obj any, tx *sql.Tx) error{},
+		afterDelete:  []func(key string, obj any, resourceVersion string, tx *sql.Tx) error{},
+		afterReplace: []func(resourceVersion string, tx *sql.Tx) error{},
+	}
+
+	err := s.InitExec(`CREATE TABLE IF NOT EXISTS metadata (
+		name VARCHAR NOT NULL PRIMARY KEY,
+		value VARCHAR NOT NULL
+	)`)
 	if err != nil {
 		return nil, err
 	}
-	db, err := sql.Open("sqlite3", path+"?mode=rwc&_journal_mode=memory&_synchronous=off&_mutex=no&_foreign_keys=on")
+	err = s.checkFingerprinted()
 	if err != nil {
 		return nil, err
 	}
-
-	s := &Store{
-		typ:         reflect.TypeOf(example),
-		keyFunc:     keyFunc,
-		db:          db,
-		afterUpsert: []func(key string, obj any, tx *sql.Tx) error{},
-		afterDelete: []func(key string, tx *sql.Tx) error{},
+	err = s.InitFingerprint("schema_version", schemaVersion)
+	if err != nil {
+		return nil, err
+	}
+	err = s.InitFingerprint("type", typeFingerprint(s.typ))
+	if err != nil {
+		return nil, err
+	}
+	err = s.InitFingerprint("codec", typeFingerprint(reflect.TypeOf(s.codec)))
+	if err != nil {
+		return nil, err
 	}
 
-	err = s.InitExec(`CREATE TABLE objects (
+	err = s.InitExec(`CREATE TABLE IF NOT EXISTS objects (
 		key VARCHAR UNIQUE NOT NULL PRIMARY KEY,
 		object BLOB
 	)`)
@@ -54,11 +110,35 @@ func NewStore(example any, keyFunc cache.KeyFunc, path string) (*Store, error) {
 		return nil, err
 	}
 
-	s.upsertStmt = s.Prepare(`INSERT INTO objects(key, object) VALUES (?, ?) ON CONFLICT DO UPDATE SET object = excluded.object`)
-	s.deleteStmt = s.Prepare(`DELETE FROM objects WHERE key = ?`)
-	s.getStmt = s.Prepare(`SELECT object FROM objects WHERE key = ?`)
-	s.listStmt = s.Prepare(`SELECT object FROM objects`)
-	s.listKeysStmt = s.Prepare(`SELECT key FROM objects`)
+	p := &statementPreparer{store: s}
+	s.upsertStmt = p.prepare(`INSERT INTO objects(key, object) VALUES (?, ?) ON CONFLICT DO UPDATE SET object = excluded.object`)
+	s.deleteStmt = p.prepare(`DELETE FROM objects WHERE key = ?`)
+	s.listKeysInTxStmt = p.prepare(`SELECT key FROM objects`)
+	s.getInTxStmt = p.prepare(`SELECT object FROM objects WHERE key = ?`)
+	s.setMetadataStmt = p.prepare(`INSERT INTO metadata(name, value) VALUES (?, ?) ON CONFLICT DO UPDATE SET value = excluded.value`)
+	s.getStmt = p.prepareRead(`SELECT object FROM objects WHERE key = ?`)
+	s.listStmt = p.prepareRead(`SELECT object FROM objects`)
+	s.listKeysStmt = p.prepareRead(`SELECT key FROM objects`)
+	s.getMetadataStmt = p.prepareRead(`SELECT value FROM metadata WHERE name = ?`)
+	if p.err != nil {
+		return nil, p.err
+	}
+
+	encodedDictionary, err := s.GetMetadata(zstdDictionaryMetadata)
+	if err != nil {
+		return nil, err
+	}
+	dictionary, err := decodeDictionary(encodedDictionary)
+	if err != nil {
+		return nil, err
+	}
+	s.compressor, err = newCompressor(o.compression, o.dictionarySamples, dictionary)
+	if err != nil {
+		return nil, err
+	}
+	if o.coalescingInterval > 0 || o.coalescingMaxWrites > 0 {
+		s.coalescer = newCoalescer(s, o.coalescingInterval, o.coalescingMaxWrites)
+	}
 
 	return s, nil
 }
@@ -67,47 +147,74 @@ func NewStore(example any, keyFunc cache.KeyFunc, path string) (*Store, error) {
 
 // Upsert saves an obj with its key, or updates key with obj if it exists in this Store
 func (s *Store) Upsert(key string, obj any) error {
-	tx, err := s.db.Begin()
-	if err != nil {
-		return err
+	if s.coalescer != nil {
+		return s.coalescer.enqueue(&pendingWrite{key: key, obj: obj})
 	}
 
-	_, err = tx.Stmt(s.upsertStmt).Exec(key, s.toBytes(obj))
+	b, err := s.Begin()
 	if err != nil {
-		return s.rollback(err, tx)
+		return err
 	}
-
-	err = s.runAfterUpsert(key, obj, tx)
+	err = b.Upsert(key, obj)
 	if err != nil {
-		return s.rollback(err, tx)
+		return b.rollback(err)
 	}
-
-	return tx.Commit()
+	return b.Commit()
 }
 
 // DeleteByKey deletes the object associated with key, if it exists in this Store
 func (s *Store) DeleteByKey(key string) error {
-	tx, err := s.db.Begin()
+	return s.delete(key, nil)
+}
+
+// delete deletes the object associated with key, passing obj (its final state, if known) to registered functions
+func (s *Store) delete(key string, obj any) error {
+	if s.coalescer != nil {
+		return s.coalescer.enqueue(&pendingWrite{key: key, obj: obj, delete: true})
+	}
+
+	b, err := s.Begin()
 	if err != nil {
 		return err
 	}
-
-	_, err = tx.Stmt(s.deleteStmt).Exec(key)
+	err = s.deleteByKey(key, obj, "", b.tx)
 	if err != nil {
-		return s.rollback(err, tx)
+		return b.rollback(err)
 	}
+	return b.Commit()
+}
 
-	err = s.runAfterDelete(key, tx)
+// upsert saves obj with its key as part of tx, running registered functions
+func (s *Store) upsert(key string, obj any, tx *sql.Tx) error {
+	buf, err := s.toBytes(obj)
 	if err != nil {
-		return s.rollback(err, tx)
+		return err
+	}
+	_, err = tx.Stmt(s.upsertStmt).Exec(key, buf)
+	if err != nil {
+		return err
 	}
+	return s.runAfterUpsert(key, obj, tx)
+}
 
-	return tx.Commit()
+// deleteByKey deletes the object associated with key as part of tx, running registered functions.
+// obj is the final state of the object, if known, and resourceVersion the one of the deletion, if known
+func (s *Store) deleteByKey(key string, obj any, resourceVersion string, tx *sql.Tx) error {
+	_, err := tx.Stmt(s.deleteStmt).Exec(key)
+	if err != nil {
+		return err
+	}
+	return s.runAfterDelete(key, obj, resourceVersion, tx)
 }
 
 // GetByKey returns the object associated with the given object's key
 func (s *Store) GetByKey(key string) (item any, exists bool, err error) {
-	result, err := s.QueryObjects(s.getStmt, key)
+	return s.GetByKeyContext(context.Background(), key)
+}
+
+// GetByKeyContext is like GetByKey, but stops querying when ctx is done
+func (s *Store) GetByKeyContext(ctx context.Context, key string) (item any, exists bool, err error) {
+	result, err := s.QueryObjectsContext(ctx, s.getStmt, key)
 	if err != nil {
 		return nil, false, err
 	}
@@ -119,31 +226,61 @@ func (s *Store) GetByKey(key string) (item any, exists bool, err error) {
 	return result[0], true, nil
 }
 
-// ReplaceByKey will delete the contents of the Store, using instead the given key to obj map
+// ReplaceByKey will delete the contents of the Store, using instead the given key to obj map.
+// Only objects that were added, changed or removed are actually written, see RegisterIsUnchanged
 func (s *Store) ReplaceByKey(objects map[string]any) error {
+	return s.replaceByKey(objects, "")
+}
+
+// replaceByKey implements ReplaceByKey, additionally passing resourceVersion to functions registered to run after replace
+func (s *Store) replaceByKey(objects map[string]any, resourceVersion string) error {
+	err := s.flush()
+	if err != nil {
+		return err
+	}
+	s.trainDictionary()
+
 	tx, err := s.db.Begin()
 	if err != nil {
 		return err
 	}
 
-	keys, err := s.QueryStrings(tx.Stmt(s.listKeysStmt))
+	keys, err := s.queryStrings(context.Background(), tx.Stmt(s.listKeysInTxStmt))
 	if err != nil {
 		return s.rollback(err, tx)
 	}
 
 	for _, key := range keys {
-		_, err = tx.Stmt(s.deleteStmt).Exec(key)
-		if err != nil {
-			return s.rollback(err, tx)
+		if _, ok := objects[key]; ok {
+			continue
 		}
-		err = s.runAfterDelete(key, tx)
+		err = s.deleteByKey(key, nil, resourceVersion, tx)
 		if err != nil {
 			return s.rollback(err, tx)
 		}
 	}
 
 	for key, obj := range objects {
-		_, err = tx.Stmt(s.upsertStmt).Exec(key, s.toBytes(obj))
+		var unchanged bool
+		if len(s.isUnchanged) == 0 {
+			unchanged, err = s.isStoredUnchanged(key, obj, tx)
+		} else {
+			unchanged, err = s.runIsUnchanged(key, obj, tx)
+		}
+		if err != nil {
+			return s.rollback(err, tx)
+		}
+		if unchanged {
+			continue
+		}
+
+		var buf []byte
+		buf, err = s.toBytes(obj)
+		if err != nil {
+			return s.rollback(err, tx)
+		}
+
+		_, err = tx.Stmt(s.upsertStmt).Exec(key, buf)
 		if err != nil {
 			return s.rollback(err, tx)
 		}
@@ -153,11 +290,101 @@ func (s *Store) ReplaceByKey(objects map[string]any) error {
 		}
 	}
 
-	return tx.Commit()
+	err = s.runAfterReplace(resourceVersion, tx)
+	if err != nil {
+		return s.rollback(err, tx)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	s.runAfterCommit()
+	return nil
+}
+
+// isStoredUnchanged returns true if obj is equal to the object stored at key, which is read within tx. Objects with
+// a resourceVersion are compared by it, others are compared decoded, as encodings of equal objects can differ (eg.
+// gob encodes maps in random order)
+func (s *Store) isStoredUnchanged(key string, obj any, tx *sql.Tx) (bool, error) {
+	var buf []byte
+	err := tx.Stmt(s.getInTxStmt).QueryRow(key).Scan(&buf)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	stored, err := s.fromBytes(buf)
+	if err != nil {
+		return false, err
+	}
+
+	if o, ok := obj.(meta.Object); ok && o.GetResourceVersion() != "" {
+		if storedObject, ok := stored.(meta.Object); ok {
+			return storedObject.GetResourceVersion() == o.GetResourceVersion(), nil
+		}
+	}
+
+	// obj is compared after an encoding round trip, which might normalize it (eg. empty maps to nil)
+	encoded, err := s.codec.Encode(obj)
+	if err != nil {
+		return false, err
+	}
+	decoded, err := s.codec.Decode(encoded, s.typ)
+	if err != nil {
+		return false, err
+	}
+	return reflect.DeepEqual(stored, decoded), nil
 }
 
-// Close closes the database and prevents new queries from starting
+// GetMetadata returns the value associated with name in the metadata table, or "" if not present
+func (s *Store) GetMetadata(name string) (string, error) {
+	return s.getMetadata(context.Background(), name, nil)
+}
+
+// getMetadata implements GetMetadata. If tx is not nil, it is queried as part of it
+func (s *Store) getMetadata(ctx context.Context, name string, tx *sql.Tx) (string, error) {
+	var result []string
+	var err error
+	if tx != nil {
+		result, err = s.queryStrings(ctx, tx.StmtContext(ctx, s.getMetadataStmt), name)
+	} else {
+		result, err = s.QueryStringsContext(ctx, s.getMetadataStmt, name)
+	}
+	if err != nil {
+		return "", err
+	}
+	if len(result) == 0 {
+		return "", nil
+	}
+	return result[0], nil
+}
+
+// SetMetadata associates value with name in the metadata table, as part of tx
+func (s *Store) SetMetadata(name string, value string, tx *sql.Tx) error {
+	_, err := tx.Stmt(s.setMetadataStmt).Exec(name, value)
+	return err
+}
+
+// CompressionStats returns statistics about compression of objects stored since this Store was created
+func (s *Store) CompressionStats() CompressionStats {
+	return s.compressor.stats()
+}
+
+// Close writes any queued writes, then closes the database and prevents new queries from starting
 func (s *Store) Close() error {
+	if s.coalescer != nil {
+		s.coalescer.stop()
+	}
+	err := s.flush()
+	if err != nil {
+		return s.closeOnError(err)
+	}
+	err = s.readDB.Close()
+	if err != nil {
+		return s.closeOnError(err)
+	}
 	return s.db.Close()
 }
 
@@ -178,36 +405,49 @@ func (s *Store) Update(obj any) error {
 	return s.Add(obj)
 }
 
-// Delete deletes the given object, if it exists in this Store
+// Delete deletes the given object, if it exists in this Store. obj is expected to be the final state of the
+// object or a cache.DeletedFinalStateUnknown, keyFunc must support both
 func (s *Store) Delete(obj any) error {
 	key, err := s.keyFunc(obj)
 	if err != nil {
 		return err
 	}
 
-	return s.DeleteByKey(key)
+	return s.delete(key, obj)
 }
 
-// List returns a list of all the currently known objects
-// Note: I/O errors will panic this function, as the interface signature does not allow returning errors
+// List wraps SafeList and handles I/O errors via the ErrorHandler (by default panicking),
+// as the interface signature does not allow returning errors
 func (s *Store) List() []any {
-	result, err := s.QueryObjects(s.listStmt)
+	result, err := s.SafeList()
 	if err != nil {
-		panic(errors.Wrap(err, "Unexpected error in Store.List"))
+		s.handleError(errors.Wrap(err, "Unexpected error in Store.List"))
+		return []any{}
 	}
 	return result
 }
 
-// ListKeys returns a list of all the keys currently in this Store
-// Note: I/O errors will panic this function, as the interface signature does not allow returning errors
+// SafeList returns a list of all the currently known objects
+func (s *Store) SafeList() ([]any, error) {
+	return s.QueryObjects(s.listStmt)
+}
+
+// ListKeys wraps SafeListKeys and handles I/O errors via the ErrorHandler (by default panicking),
+// as the interface signature does not allow returning errors
 func (s *Store) ListKeys() []string {
-	result, err := s.QueryStrings(s.listKeysStmt)
+	result, err := s.SafeListKeys()
 	if err != nil {
-		panic(errors.Wrap(err, "Unexpected error in Store.ListKeys"))
+		s.handleError(errors.Wrap(err, "Unexpected error in Store.ListKeys"))
+		return []string{}
 	}
 	return result
 }
 
+// SafeListKeys returns a list of all the keys currently in this Store
+func (s *Store) SafeListKeys() ([]string, error) {
+	return s.QueryStrings(s.listKeysStmt)
+}
+
 // Get returns the object with the same key as obj
 func (s *Store) Get(obj any) (item any, exists bool, err error) {
 	key, err := s.keyFunc(obj)
@@ -219,7 +459,7 @@ func (s *Store) Get(obj any) (item any, exists bool, err error) {
 }
 
 // Replace will delete the contents of the Store, using instead the given list
-func (s *Store) Replace(objects []any, _ string) error {
+func (s *Store) Replace(objects []any, resourceVersion string) error {
 	objectMap := map[string]any{}
 
 	for _, object := range objects {
@@ -229,7 +469,7 @@ func (s *Store) Replace(objects []any, _ string) error {
 		}
 		objectMap[key] = object
 	}
-	return s.ReplaceByKey(objectMap)
+	return s.replaceByKey(objectMap, resourceVersion)
 }
 
 // Resync is a no-op and is deprecated
@@ -240,67 +480,166 @@ func (s *Store) Resync() error {
 /* Utilities */
 
 // InitExec executes a statement as part of the DB initialization, closing the connection on error
-func (s *Store) InitExec(stmt string) error {
-	_, err := s.db.Exec(stmt)
+func (s *Store) InitExec(stmt string, params ...any) error {
+	_, err := s.db.Exec(stmt, params...)
 	if err != nil {
-		cerr := s.db.Close()
-		if cerr != nil {
-			return errors.Wrapf(cerr, "Error closing the DB during initialization")
-		}
-		return errors.Wrapf(err, "Error initializing Store DB")
+		return s.closeOnError(errors.Wrapf(err, "Error initializing Store DB"))
+	}
+	return nil
+}
+
+// InitFingerprint records value under name in the metadata table as part of the DB initialization.
+// If a different value was recorded already (eg. by a previous process using an incompatible type or configuration)
+// an error is returned and the connection is closed
+func (s *Store) InitFingerprint(name string, value string) error {
+	var existing string
+	err := s.db.QueryRow(`SELECT value FROM metadata WHERE name = ?`, name).Scan(&existing)
+	if err == sql.ErrNoRows {
+		return s.InitExec(`INSERT INTO metadata(name, value) VALUES (?, ?)`, name, value)
+	}
+	if err == nil && existing != value {
+		err = errors.Errorf("Incompatible existing database: %s is %q, expected %q", name, existing, value)
+	}
+	if err != nil {
+		return s.closeOnError(errors.Wrapf(err, "Error initializing Store DB"))
+	}
+	return nil
+}
+
+// checkFingerprinted returns an error if the DB has objects but no recorded schema version, as databases written
+// before fingerprints were introduced. Such databases cannot be reopened
+func (s *Store) checkFingerprinted() error {
+	var unfingerprinted bool
+	err := s.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = 'objects')
+		AND NOT EXISTS (SELECT 1 FROM metadata WHERE name = 'schema_version')`).Scan(&unfingerprinted)
+	if err == nil && unfingerprinted {
+		err = errors.Errorf("Incompatible existing database: schema_version is not recorded, expected %q", schemaVersion)
+	}
+	if err != nil {
+		return s.closeOnError(errors.Wrapf(err, "Error initializing Store DB"))
 	}
 	return nil
 }
 
-// Prepare prepares a statement
+// closeOnError closes all connections after err, wrapping errors if needed
+func (s *Store) closeOnError(err error) error {
+	cerr := s.readDB.Close()
+	if cerr != nil {
+		return errors.Wrap(cerr, "while handling "+err.Error())
+	}
+	cerr = s.db.Close()
+	if cerr != nil {
+		return errors.Wrap(cerr, "while handling "+err.Error())
+	}
+	return err
+}
+
+// Prepare wraps SafePrepare and panics on errors. Only meant for statically known statements
 func (s *Store) Prepare(stmt string) *sql.Stmt {
-	prepared, err := s.db.Prepare(stmt)
+	prepared, err := s.SafePrepare(stmt)
 	if err != nil {
-		panic(errors.Errorf("Error preparing statement: %s\n%v", stmt, err))
+		panic(err)
 	}
 	return prepared
 }
 
-// QueryObjects runs a prepared statement that returns gobbed objects of type typ
-func (s *Store) QueryObjects(stmt *sql.Stmt, params ...any) ([]any, error) {
-	rows, err := stmt.Query(params...)
+// SafePrepare prepares a statement on the writer connection. Such statements can be used in write transactions
+// via tx.Stmt, and while they can also be run directly, they will wait for any write transaction in progress
+func (s *Store) SafePrepare(stmt string) (*sql.Stmt, error) {
+	return s.SafePrepareContext(context.Background(), stmt)
+}
+
+// SafePrepareContext is like SafePrepare, but stops preparing when ctx is done
+func (s *Store) SafePrepareContext(ctx context.Context, stmt string) (*sql.Stmt, error) {
+	return prepare(ctx, s.db, stmt)
+}
+
+// PrepareRead wraps SafePrepareRead and panics on errors. Only meant for statically known statements
+func (s *Store) PrepareRead(stmt string) *sql.Stmt {
+	prepared, err := s.SafePrepareRead(stmt)
 	if err != nil {
-		return nil, err
+		panic(err)
 	}
+	return prepared
+}
 
-	var result []any
-	for rows.Next() {
-		var buf sql.RawBytes
-		err := rows.Scan(&buf)
-		if err != nil {
-			return s.closeOnError(rows, err)
-		}
+// SafePrepareRead prepares a read-only statement on the reader connections. Such statements run concurrently with
+// each other and with writes, but cannot be used in write transactions
+func (s *Store) SafePrepareRead(stmt string) (*sql.Stmt, error) {
+	return s.SafePrepareReadContext(context.Background(), stmt)
+}
 
-		singleResult, err := s.fromBytes(buf)
-		if err != nil {
-			return s.closeOnError(rows, err)
-		}
-		result = append(result, singleResult.Elem().Interface())
+// SafePrepareReadContext is like SafePrepareRead, but stops preparing when ctx is done
+func (s *Store) SafePrepareReadContext(ctx context.Context, stmt string) (*sql.Stmt, error) {
+	return prepare(ctx, s.readDB, stmt)
+}
+
+// statementPreparer prepares statements in sequence, keeping the first error, so that constructors can check it once
+type statementPreparer struct {
+	store *Store
+	err   error
+}
+
+// prepare is like SafePrepare, but does nothing after an error
+func (p *statementPreparer) prepare(stmt string) *sql.Stmt {
+	if p.err != nil {
+		return nil
 	}
-	err = rows.Err()
+	var prepared *sql.Stmt
+	prepared, p.err = p.store.SafePrepare(stmt)
+	return prepared
+}
+
+// prepareRead is like SafePrepareRead, but does nothing after an error
+func (p *statementPreparer) prepareRead(stmt string) *sql.Stmt {
+	if p.err != nil {
+		return nil
+	}
+	var prepared *sql.Stmt
+	prepared, p.err = p.store.SafePrepareRead(stmt)
+	return prepared
+}
+
+// prepare prepares stmt on db, wrapping errors
+func prepare(ctx context.Context, db *sql.DB, stmt string) (*sql.Stmt, error) {
+	prepared, err := db.PrepareContext(ctx, stmt)
 	if err != nil {
-		if err != nil {
-			return s.closeOnError(rows, err)
-		}
-		return nil, err
+		return nil, errors.Wrapf(err, "Error preparing statement: %s", stmt)
 	}
+	return prepared, nil
+}
 
-	err = rows.Close()
+// QueryObjects runs a prepared statement that returns encoded objects of type typ
+func (s *Store) QueryObjects(stmt *sql.Stmt, params ...any) ([]any, error) {
+	return s.QueryObjectsContext(context.Background(), stmt, params...)
+}
+
+// QueryObjectsContext is like QueryObjects, but stops querying when ctx is done
+func (s *Store) QueryObjectsContext(ctx context.Context, stmt *sql.Stmt, params ...any) ([]any, error) {
+	it, err := s.QueryObjectsIter(ctx, stmt, params...)
 	if err != nil {
 		return nil, err
 	}
-
-	return result, nil
+	return it.collect()
 }
 
 // QueryStrings runs a prepared statement that returns strings
 func (s *Store) QueryStrings(stmt *sql.Stmt, params ...any) ([]string, error) {
-	rows, err := stmt.Query(params...)
+	return s.QueryStringsContext(context.Background(), stmt, params...)
+}
+
+// QueryStringsContext is like QueryStrings, but stops querying when ctx is done
+func (s *Store) QueryStringsContext(ctx context.Context, stmt *sql.Stmt, params ...any) ([]string, error) {
+	err := s.flush()
+	if err != nil {
+		return nil, err
+	}
+	return s.queryStrings(ctx, stmt, params...)
+}
+
+// queryStrings implements QueryStringsContext without flushing queued writes, for use in transactions
+func (s *Store) queryStrings(ctx context.Context, stmt *sql.Stmt, params ...any) ([]string, error) {
+	rows, err := stmt.QueryContext(ctx, params...)
 	if err != nil {
 		return nil, err
 	}
@@ -314,6 +653,7 @@ func (s *Store) QueryStrings(stmt *sql.Stmt, params ...any) ([]string, error) {
 			if ce != nil {
 				return nil, errors.Wrap(ce, "while handling "+err.Error())
 			}
+			return nil, err
 		}
 
 		result = append(result, key)
@@ -324,6 +664,7 @@ func (s *Store) QueryStrings(stmt *sql.Stmt, params ...any) ([]string, error) {
 		if ce != nil {
 			return nil, errors.Wrap(ce, "while handling "+err.Error())
 		}
+		return nil, err
 	}
 
 	err = rows.Close()
@@ -334,24 +675,51 @@ func (s *Store) QueryStrings(stmt *sql.Stmt, params ...any) ([]string, error) {
 	return result, nil
 }
 
-// toBytes encodes an object to a byte slice
-func (s *Store) toBytes(obj any) []byte {
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	err := enc.Encode(obj)
+// toBytes encodes and compresses an object to a byte slice
+func (s *Store) toBytes(obj any) ([]byte, error) {
+	buf, err := s.codec.Encode(obj)
 	if err != nil {
-		panic(errors.Wrap(err, "Error while gobbing object"))
+		return nil, err
 	}
-	bb := buf.Bytes()
-	return bb
+	return s.compressor.compress(buf)
 }
 
-// fromBytes decodes an object from a byte slice
-func (s *Store) fromBytes(buf sql.RawBytes) (reflect.Value, error) {
-	dec := gob.NewDecoder(bytes.NewReader(buf))
-	singleResult := reflect.New(s.typ)
-	err := dec.DecodeValue(singleResult)
-	return singleResult, err
+// fromBytes decompresses and decodes an object from a byte slice
+func (s *Store) fromBytes(buf sql.RawBytes) (any, error) {
+	decompressed, err := s.compressor.decompress(buf)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while decompressing object")
+	}
+	return s.codec.Decode(decompressed, s.typ)
+}
+
+// trainDictionary trains a compression dictionary, if enough samples were collected, and persists it.
+// Failures are not fatal, objects just keep being compressed without a dictionary
+func (s *Store) trainDictionary() {
+	dictionary, err := s.compressor.trainDictionary()
+	if err == nil && dictionary != nil {
+		err = s.saveDictionary(dictionary)
+	}
+	if err != nil {
+		klog.Warningf("Compression dictionary could not be trained, continuing without: %v", err)
+	}
+}
+
+// saveDictionary persists a compression dictionary, then starts using it
+func (s *Store) saveDictionary(dictionary []byte) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	err = s.SetMetadata(zstdDictionaryMetadata, encodeDictionary(dictionary), tx)
+	if err != nil {
+		return s.rollback(err, tx)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	return s.compressor.setDictionary(dictionary)
 }
 
 // rollback handles rollbacks and wraps errors if needed
@@ -360,7 +728,7 @@ func (s *Store) rollback(err error, tx *sql.Tx) error {
 	if rerr != nil {
 		return errors.Wrapf(rerr, "Error while rolling back from: %v", err)
 	}
-	return rerr
+	return err
 }
 
 // RegisterAfterUpsert registers a func to be called after each upsert
@@ -379,15 +747,33 @@ func (s *Store) runAfterUpsert(key string, obj any, tx *sql.Tx) error {
 	return nil
 }
 
-// RegisterAfterDelete registers a func to be called after each deletion
-func (s *Store) RegisterAfterDelete(f func(key string, tx *sql.Tx) error) {
+// RegisterAfterDelete registers a func to be called after each deletion. obj is the final state of the deleted
+// object (possibly a cache.DeletedFinalStateUnknown) if passed to Delete, nil otherwise. resourceVersion is the one
+// passed to Replace for objects deleted by it, "" otherwise
+func (s *Store) RegisterAfterDelete(f func(key string, obj any, resourceVersion string, tx *sql.Tx) error) {
 	s.afterDelete = append(s.afterDelete, f)
 }
 
-// runAfterDelete executes functions registered to run after upsert
-func (s *Store) runAfterDelete(key string, tx *sql.Tx) error {
+// runAfterDelete executes functions registered to run after deletion
+func (s *Store) runAfterDelete(key string, obj any, resourceVersion string, tx *sql.Tx) error {
 	for _, f := range s.afterDelete {
-		err := f(key, tx)
+		err := f(key, obj, resourceVersion, tx)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RegisterAfterReplace registers a func to be called after each replacement of the whole Store contents
+func (s *Store) RegisterAfterReplace(f func(resourceVersion string, tx *sql.Tx) error) {
+	s.afterReplace = append(s.afterReplace, f)
+}
+
+// runAfterReplace executes functions registered to run after replace
+func (s *Store) runAfterReplace(resourceVersion string, tx *sql.Tx) error {
+	for _, f := range s.afterReplace {
+		err := f(resourceVersion, tx)
 		if err != nil {
 			return err
 		}
@@ -395,12 +781,67 @@ func (s *Store) runAfterDelete(key string, tx *sql.Tx) error {
 	return nil
 }
 
-// closeOnError closes the sql.Rows object and wraps errors if needed
-func (s *Store) closeOnError(rows *sql.Rows, err error) ([]any, error) {
-	ce := rows.Close()
-	if ce != nil {
-		return nil, errors.Wrap(ce, "while handling "+err.Error())
+// RegisterIsUnchanged registers a func to determine whether obj is unchanged from what is currently stored at key,
+// in which case it is skipped during replace. Any registered func returning true is sufficient.
+// If none is registered, decoded objects are compared instead
+func (s *Store) RegisterIsUnchanged(f func(key string, obj any, tx *sql.Tx) (bool, error)) {
+	s.isUnchanged = append(s.isUnchanged, f)
+}
+
+// runIsUnchanged executes functions registered to determine whether an object is unchanged
+func (s *Store) runIsUnchanged(key string, obj any, tx *sql.Tx) (bool, error) {
+	for _, f := range s.isUnchanged {
+		unchanged, err := f(key, obj, tx)
+		if err != nil || unchanged {
+			return unchanged, err
+		}
 	}
+	return false, nil
+}
+
+// RegisterAfterCommit registers a func to be called after each transaction writing objects is committed.
+// It is called synchronously, so it should return quickly
+func (s *Store) RegisterAfterCommit(f func()) {
+	s.afterCommit = append(s.afterCommit, f)
+}
+
+// runAfterCommit executes functions registered to run after commit
+func (s *Store) runAfterCommit() {
+	for _, f := range s.afterCommit {
+		f()
+	}
+}
+
+// removeDatabase deletes the database at path, along with its WAL and shared memory files
+func removeDatabase(path string) error {
+	for _, suffix := range []string{"", "-wal", "-shm", "-journal"} {
+		err := os.RemoveAll(path + suffix)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// typeFingerprint returns a string identifying t, including its package path
+func typeFingerprint(t reflect.Type) string {
+	if t == nil {
+		return "nil"
+	}
+	prefix := ""
+	for t.Kind() == reflect.Pointer {
+		prefix += "*"
+		t = t.Elem()
+	}
+	if t.Name() == "" || t.PkgPath() == "" {
+		return prefix + t.String()
+	}
+	return prefix + t.PkgPath() + "." + t.Name()
+}
 
-	return nil, err
+// namesFingerprint returns a string identifying a set of names, regardless of their order
+func namesFingerprint(names []string) string {
+	sorted := append([]string{}, names...)
+	sort.Strings(sorted)
+	return strings.Join(sorted, ",")
 }
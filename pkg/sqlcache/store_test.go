@@ -7,8 +7,13 @@ Adapted from client-go, Copyright 2014 The Kubernetes Authors.
 package sqlcache
 
 import (
+	"database/sql"
+	"fmt"
+	"strings"
 	"testing"
 
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/client-go/tools/cache"
 )
@@ -133,13 +138,258 @@ type testStoreObject struct {
 }
 
 func TestStore(t *testing.T) {
+	for name, codec := range testCodecs() {
+		t.Run(name, func(t *testing.T) {
+			store, err := NewStore(testStoreObject{}, testStoreKeyFunc, TEST_DB_LOCATION, WithCodec(codec))
+			if err != nil {
+				t.Error(err)
+			}
+			doTestStore(t, store)
+			err = store.Close()
+			if err != nil {
+				return
+			}
+		})
+	}
+}
+
+func TestStoreReopen(t *testing.T) {
+	store, err := NewStore(testStoreObject{}, testStoreKeyFunc, TEST_DB_LOCATION)
+	if err != nil {
+		t.Error(err)
+	}
+	err = store.Add(testStoreObject{Id: "a", Val: "b"})
+	if err != nil {
+		t.Error(err)
+	}
+	err = store.Close()
+	if err != nil {
+		t.Error(err)
+	}
+
+	// reopening keeps existing data
+	store, err = NewStore(testStoreObject{}, testStoreKeyFunc, TEST_DB_LOCATION, WithReopen())
+	if err != nil {
+		t.Error(err)
+	}
+	item, exists, err := store.GetByKey("a")
+	if err != nil {
+		t.Error(err)
+	}
+	if !exists || item.(testStoreObject).Val != "b" {
+		t.Errorf("expected reopened store to contain a, got %v", item)
+	}
+	err = store.Close()
+	if err != nil {
+		t.Error(err)
+	}
+
+	// reopening with a different type fails
+	_, err = NewStore("", testStoreKeyFunc, TEST_DB_LOCATION, WithReopen())
+	if err == nil {
+		t.Errorf("expected an error reopening a store with a different type")
+	}
+
+	// reopening a database written before schema versions were recorded fails
+	db, err := sql.Open("sqlite3", TEST_DB_LOCATION)
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = db.Exec(`DELETE FROM metadata WHERE name = 'schema_version'`)
+	if err != nil {
+		t.Error(err)
+	}
+	err = db.Close()
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = NewStore(testStoreObject{}, testStoreKeyFunc, TEST_DB_LOCATION, WithReopen())
+	if err == nil || !strings.Contains(err.Error(), "Incompatible existing database") {
+		t.Errorf("expected an error reopening a store without a schema version, got %v", err)
+	}
+
+	// not reopening wipes existing data
+	store, err = NewStore(testStoreObject{}, testStoreKeyFunc, TEST_DB_LOCATION)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(store.ListKeys()) != 0 {
+		t.Errorf("expected store to be wiped")
+	}
+	err = store.Close()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStoreReplaceOnlyWritesDifferences(t *testing.T) {
+	store, err := NewStore(testStoreObject{}, testStoreKeyFunc, TEST_DB_LOCATION)
+	if err != nil {
+		t.Error(err)
+	}
+	upserted := sets.String{}
+	deleted := sets.String{}
+	store.RegisterAfterUpsert(func(key string, obj any, tx *sql.Tx) error {
+		upserted.Insert(key)
+		return nil
+	})
+	store.RegisterAfterDelete(func(key string, obj any, resourceVersion string, tx *sql.Tx) error {
+		deleted.Insert(key)
+		return nil
+	})
+
+	err = store.Replace([]any{
+		testStoreObject{Id: "a", Val: "a"},
+		testStoreObject{Id: "b", Val: "b"},
+		testStoreObject{Id: "c", Val: "c"},
+	}, "1")
+	if err != nil {
+		t.Error(err)
+	}
+	if !upserted.Equal(sets.NewString("a", "b", "c")) || deleted.Len() != 0 {
+		t.Errorf("unexpected writes, upserted: %v, deleted: %v", upserted, deleted)
+	}
+
+	upserted = sets.String{}
+	err = store.Replace([]any{
+		testStoreObject{Id: "a", Val: "a"},
+		testStoreObject{Id: "b", Val: "b2"},
+		testStoreObject{Id: "d", Val: "d"},
+	}, "2")
+	if err != nil {
+		t.Error(err)
+	}
+	if !upserted.Equal(sets.NewString("b", "d")) || !deleted.Equal(sets.NewString("c")) {
+		t.Errorf("unexpected writes, upserted: %v, deleted: %v", upserted, deleted)
+	}
+	item, _, err := store.GetByKey("b")
+	if err != nil {
+		t.Error(err)
+	}
+	if item.(testStoreObject).Val != "b2" {
+		t.Errorf("expected b to be updated, got %v", item)
+	}
+
+	err = store.Close()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStoreReplaceSkipsUnchangedObjectsWithMaps(t *testing.T) {
+	keyFunc := func(obj any) (string, error) {
+		return obj.(*v1.Pod).Name, nil
+	}
+	store, err := NewStore(&v1.Pod{}, keyFunc, TEST_DB_LOCATION)
+	if err != nil {
+		t.Error(err)
+	}
+	upserted := sets.String{}
+	store.RegisterAfterUpsert(func(key string, obj any, tx *sql.Tx) error {
+		upserted.Insert(key)
+		return nil
+	})
+
+	// gob encodes maps in random order, so encodings of equal objects differ
+	pods := func() []any {
+		labels := map[string]string{}
+		for i := 0; i < 20; i++ {
+			labels[fmt.Sprintf("label%d", i)] = fmt.Sprint(i)
+		}
+		return []any{
+			&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "a", Labels: labels, Annotations: map[string]string{}}},
+			&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "b", Labels: labels}},
+		}
+	}
+	err = store.Replace(pods(), "1")
+	if err != nil {
+		t.Error(err)
+	}
+	for i := 0; i < 10; i++ {
+		upserted = sets.String{}
+		err = store.Replace(pods(), "1")
+		if err != nil {
+			t.Error(err)
+		}
+		if upserted.Len() != 0 {
+			t.Errorf("unexpected writes of unchanged objects: %v", upserted)
+		}
+	}
+
+	err = store.Close()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStoreReplaceComparesResourceVersions(t *testing.T) {
+	keyFunc := func(obj any) (string, error) {
+		return obj.(*v1.Pod).Name, nil
+	}
+	store, err := NewStore(&v1.Pod{}, keyFunc, TEST_DB_LOCATION)
+	if err != nil {
+		t.Error(err)
+	}
+	upserted := sets.String{}
+	store.RegisterAfterUpsert(func(key string, obj any, tx *sql.Tx) error {
+		upserted.Insert(key)
+		return nil
+	})
+
+	pod := func(name string, resourceVersion string, nodeName string) any {
+		return &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name, ResourceVersion: resourceVersion},
+			Spec:       v1.PodSpec{NodeName: nodeName},
+		}
+	}
+	err = store.Replace([]any{pod("a", "1", "node1"), pod("b", "2", "node1")}, "2")
+	if err != nil {
+		t.Error(err)
+	}
+
+	// objects with the same resourceVersion are considered unchanged
+	upserted = sets.String{}
+	err = store.Replace([]any{pod("a", "1", "node2"), pod("b", "3", "node2")}, "3")
+	if err != nil {
+		t.Error(err)
+	}
+	if !upserted.Equal(sets.NewString("b")) {
+		t.Errorf("unexpected writes, upserted: %v", upserted)
+	}
+
+	err = store.Close()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStatementPreparer(t *testing.T) {
 	store, err := NewStore(testStoreObject{}, testStoreKeyFunc, TEST_DB_LOCATION)
 	if err != nil {
 		t.Error(err)
 	}
-	doTestStore(t, store)
+
+	p := &statementPreparer{store: store}
+	stmt := p.prepareRead(`SELECT key FROM objects`)
+	if stmt == nil || p.err != nil {
+		t.Errorf("expected a prepared statement, got error %v", p.err)
+	}
+	err = stmt.Close()
+	if err != nil {
+		t.Error(err)
+	}
+
+	// the first error is kept, later statements are not prepared
+	if p.prepare(`SELECT nonexistent FROM objects`) != nil || p.err == nil {
+		t.Errorf("expected an error")
+	}
+	firstErr := p.err
+	if p.prepareRead(`SELECT key FROM objects`) != nil || p.err != firstErr {
+		t.Errorf("expected no statement after an error, got error %v", p.err)
+	}
+
 	err = store.Close()
 	if err != nil {
-		return
+		t.Error(err)
 	}
 }
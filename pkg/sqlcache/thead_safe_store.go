@@ -5,14 +5,29 @@ import (
 	"k8s.io/client-go/tools/cache"
 )
 
+// SafeThreadSafeStore is a cache.ThreadSafeStore that also offers error-returning variants of all its methods.
+// Stores returned by NewThreadSafeStore can be type-asserted to it
+type SafeThreadSafeStore interface {
+	cache.ThreadSafeStore
+
+	SafeAdd(key string, obj any) error
+	SafeUpdate(key string, obj any) error
+	SafeDelete(key string) error
+	SafeGet(key string) (item any, exists bool, err error)
+	SafeList() ([]any, error)
+	SafeListKeys() ([]string, error)
+	SafeReplace(m map[string]any, resourceVersion string) error
+	SafeListIndexFuncValues(name string) ([]string, error)
+}
+
 // threadSafeStore is a SQLite-backed cache.ThreadSafeStore which builds upon Index
 type threadSafeStore struct {
 	*Indexer
 }
 
 // NewThreadSafeStore returns a cache.ThreadSafeStore backed by SQLite for the example type
-func NewThreadSafeStore(example any, path string, indexers cache.Indexers) (cache.ThreadSafeStore, error) {
-	i, err := NewIndexer(example, dummyKeyFunc, path, indexers)
+func NewThreadSafeStore(example any, path string, indexers cache.Indexers, opts ...Option) (cache.ThreadSafeStore, error) {
+	i, err := NewIndexer(example, dummyKeyFunc, path, indexers, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -20,49 +35,78 @@ func NewThreadSafeStore(example any, path string, indexers cache.Indexers) (cach
 	return &threadSafeStore{i}, nil
 }
 
-// Add saves an obj with its key, or updates key with obj if it exists in this store
-// Note: I/O errors will panic this function, as the interface signature does not allow returning errors
+// Add wraps SafeAdd and handles I/O errors via the ErrorHandler (by default panicking),
+// as the interface signature does not allow returning errors
 func (t threadSafeStore) Add(key string, obj any) {
-	err := t.Upsert(key, obj)
+	err := t.SafeAdd(key, obj)
 	if err != nil {
-		panic(errors.Wrap(err, "Unexpected error in threadSafeStore.Add"))
+		t.handleError(errors.Wrap(err, "Unexpected error in threadSafeStore.Add"))
 	}
 }
 
-// Update delegates to Add
-// Note: I/O errors will panic this function, as the interface signature does not allow returning errors
+// SafeAdd saves an obj with its key, or updates key with obj if it exists in this store
+func (t threadSafeStore) SafeAdd(key string, obj any) error {
+	return t.Upsert(key, obj)
+}
+
+// Update wraps SafeUpdate and handles I/O errors via the ErrorHandler (by default panicking),
+// as the interface signature does not allow returning errors
 func (t threadSafeStore) Update(key string, obj any) {
-	t.Add(key, obj)
+	err := t.SafeUpdate(key, obj)
+	if err != nil {
+		t.handleError(errors.Wrap(err, "Unexpected error in threadSafeStore.Update"))
+	}
 }
 
-// Delete deletes the object associated with key, if it exists in this store
-// Note: I/O errors will panic this function, as the interface signature does not allow returning errors
+// SafeUpdate delegates to SafeAdd
+func (t threadSafeStore) SafeUpdate(key string, obj any) error {
+	return t.SafeAdd(key, obj)
+}
+
+// Delete wraps SafeDelete and handles I/O errors via the ErrorHandler (by default panicking),
+// as the interface signature does not allow returning errors
 func (t threadSafeStore) Delete(key string) {
-	err := t.DeleteByKey(key)
+	err := t.SafeDelete(key)
 	if err != nil {
-		panic(errors.Wrap(err, "Unexpected error in threadSafeStore.Delete"))
+		t.handleError(errors.Wrap(err, "Unexpected error in threadSafeStore.Delete"))
 	}
 }
 
-// Get returns the object associated with the given object's key
-// Note: I/O errors will panic this function, as the interface signature does not allow returning errors
+// SafeDelete deletes the object associated with key, if it exists in this store
+func (t threadSafeStore) SafeDelete(key string) error {
+	return t.DeleteByKey(key)
+}
+
+// Get wraps SafeGet and handles I/O errors via the ErrorHandler (by default panicking),
+// as the interface signature does not allow returning errors
 func (t threadSafeStore) Get(key string) (any, bool) {
-	item, exists, err := t.GetByKey(key)
+	item, exists, err := t.SafeGet(key)
 	if err != nil {
-		panic(errors.Wrap(err, "Unexpected error in threadSafeStore.Get"))
+		t.handleError(errors.Wrap(err, "Unexpected error in threadSafeStore.Get"))
+		return nil, false
 	}
 	return item, exists
 }
 
-// Replace will delete the contents of the store, using instead the given list
-// Note: I/O errors will panic this function, as the interface signature does not allow returning errors
-func (t threadSafeStore) Replace(m map[string]any, _ string) {
-	err := t.ReplaceByKey(m)
+// SafeGet returns the object associated with the given object's key
+func (t threadSafeStore) SafeGet(key string) (item any, exists bool, err error) {
+	return t.GetByKey(key)
+}
+
+// Replace wraps SafeReplace and handles I/O errors via the ErrorHandler (by default panicking),
+// as the interface signature does not allow returning errors
+func (t threadSafeStore) Replace(m map[string]any, resourceVersion string) {
+	err := t.SafeReplace(m, resourceVersion)
 	if err != nil {
-		panic(errors.Wrap(err, "Unexpected error in threadSafeStore.Replace"))
+		t.handleError(errors.Wrap(err, "Unexpected error in threadSafeStore.Replace"))
 	}
 }
 
+// SafeReplace will delete the contents of the store, using instead the given list
+func (t threadSafeStore) SafeReplace(m map[string]any, resourceVersion string) error {
+	return t.replaceByKey(m, resourceVersion)
+}
+
 // dummyKeyFunc panics - ThreadSafeStore is designed to work without one
 func dummyKeyFunc(obj any) (string, error) {
 	panic("keyFunc called from ThreadSafeStore")
@@ -4,35 +4,58 @@ import (
 	"database/sql"
 	_ "github.com/mattn/go-sqlite3"
 	"k8s.io/client-go/tools/cache"
+	"strconv"
+	"sync"
+	"time"
 )
 
 // VersionedIndexer extends Indexer by storing a range of versions in addition to the latest one
 type VersionedIndexer struct {
 	*Indexer
 	versionFunc VersionFunc
+	gc          *garbageCollector
+	now         func() time.Time
 
-	addHistoryStmt    *sql.Stmt
-	deleteHistoryStmt *sql.Stmt
-	getByVersionStmt  *sql.Stmt
+	watchersLock sync.Mutex
+	watchers     map[*historyWatcher]struct{}
+	watchersWait sync.WaitGroup
+
+	addHistoryStmt     *sql.Stmt
+	deleteHistoryStmt  *sql.Stmt
+	latestVersionsStmt *sql.Stmt
+	getByVersionStmt   *sql.Stmt
+	isLatestStmt       *sql.Stmt
+	listVersionsStmt   *sql.Stmt
+	getAtOrBeforeStmt  *sql.Stmt
+	listEventsStmt     *sql.Stmt
 }
 
 type VersionFunc func(obj any) (int, error)
 
 // NewVersionedIndexer returns an Indexer that also stores a range of versions in addition to the latest one
-func NewVersionedIndexer(example any, keyFunc cache.KeyFunc, versionFunc VersionFunc, path string, indexers cache.Indexers) (*VersionedIndexer, error) {
-	i, err := NewIndexer(example, keyFunc, path, indexers)
+func NewVersionedIndexer(example any, keyFunc cache.KeyFunc, versionFunc VersionFunc, path string, indexers cache.Indexers, opts ...Option) (*VersionedIndexer, error) {
+	i, err := NewIndexer(example, keyFunc, path, indexers, opts...)
+	if err != nil {
+		return nil, err
+	}
 
-	err = i.InitExec(`CREATE TABLE object_history (
+	err = i.InitExec(`CREATE TABLE IF NOT EXISTS object_history (
 			key VARCHAR NOT NULL,
 			version INTEGER NOT NULL,
 			deleted_version INTEGER DEFAULT NULL,
 			object BLOB NOT NULL,
+			created_at INTEGER NOT NULL,
+			deleted_at INTEGER DEFAULT NULL,
 			PRIMARY KEY (key, version)
 	   )`)
 	if err != nil {
 		return nil, err
 	}
-	err = i.InitExec(`CREATE INDEX object_history_version ON object_history(version)`)
+	err = i.InitExec(`CREATE INDEX IF NOT EXISTS object_history_version ON object_history(version)`)
+	if err != nil {
+		return nil, err
+	}
+	err = i.InitExec(`CREATE INDEX IF NOT EXISTS object_history_deleted_version ON object_history(deleted_version)`)
 	if err != nil {
 		return nil, err
 	}
@@ -40,18 +63,74 @@ func NewVersionedIndexer(example any, keyFunc cache.KeyFunc, versionFunc Version
 	v := &VersionedIndexer{
 		Indexer:     i,
 		versionFunc: versionFunc,
+		now:         time.Now,
+		watchers:    map[*historyWatcher]struct{}{},
 	}
 	v.RegisterAfterUpsert(v.AfterUpsert)
 	v.RegisterAfterDelete(v.AfterDelete)
+	v.RegisterIsUnchanged(v.IsUnchanged)
+	v.RegisterAfterCommit(v.notifyWatchers)
 
-	v.addHistoryStmt = v.Prepare(`INSERT INTO object_history(key, version, deleted_version, object)
-		SELECT ?, ?, NULL, object
+	p := &statementPreparer{store: v.Store}
+	v.addHistoryStmt = p.prepare(`INSERT INTO object_history(key, version, deleted_version, object, created_at)
+		SELECT ?, ?, NULL, object, ?
 			FROM objects
 			WHERE key = ?
 			ON CONFLICT
-			    DO UPDATE SET object = excluded.object, deleted_version = NULL`)
-	v.deleteHistoryStmt = v.Prepare(`UPDATE object_history SET deleted_version = (SELECT MAX(version) FROM object_history) WHERE key = ?`)
-	v.getByVersionStmt = v.Prepare(`SELECT object FROM object_history WHERE key = ? AND version = ? AND (deleted_version IS NULL OR deleted_version > ?)`)
+			    DO UPDATE SET object = excluded.object, deleted_version = NULL, deleted_at = NULL`)
+	v.deleteHistoryStmt = p.prepare(`UPDATE object_history SET deleted_version = ?, deleted_at = ? WHERE key = ? AND deleted_version IS NULL`)
+	v.latestVersionsStmt = p.prepare(`SELECT
+		COALESCE((SELECT MAX(version) FROM object_history WHERE key = ?), 0),
+		COALESCE((SELECT MAX(MAX(version), COALESCE(MAX(deleted_version), 0)) FROM object_history), 0)`)
+	v.isLatestStmt = p.prepare(`SELECT COUNT(*) FROM object_history
+		WHERE key = ? AND version = ? AND deleted_version IS NULL
+			AND version = (SELECT MAX(version) FROM object_history WHERE key = ?)`)
+	v.getByVersionStmt = p.prepareRead(`SELECT object FROM object_history WHERE key = ? AND version = ? AND (deleted_version IS NULL OR deleted_version > ?)`)
+	// a version is followed by its deletion unless there is a later version before the deletion
+	v.listVersionsStmt = p.prepareRead(`SELECT version, deleted, CASE WHEN deleted THEN deleted_version ELSE 0 END
+		FROM (
+			SELECT version, deleted_version,
+				deleted_version IS NOT NULL AND COALESCE(LEAD(version) OVER (ORDER BY version) >= deleted_version, TRUE) AS deleted
+			FROM object_history
+			WHERE key = ?
+		)
+		ORDER BY version`)
+	// an object is ADDED unless it has a previous version not deleted before this one. Events are listed in pages,
+	// after a given (version, key, type)
+	v.listEventsStmt = p.prepareRead(`SELECT version, key, type, object FROM (
+			SELECT h.version AS version, h.key AS key,
+				CASE WHEN p.version IS NULL OR p.deleted_version <= h.version THEN 'ADDED' ELSE 'MODIFIED' END AS type,
+				h.object AS object
+			FROM object_history h
+				LEFT JOIN object_history p ON p.key = h.key
+					AND p.version = (SELECT MAX(version) FROM object_history WHERE key = h.key AND version < h.version)
+			WHERE h.version >= ?
+			UNION ALL
+			SELECT h.deleted_version, h.key, 'DELETED', h.object
+			FROM object_history h
+			WHERE h.deleted_version >= ?
+				AND NOT EXISTS (SELECT 1 FROM object_history n WHERE n.key = h.key AND n.version > h.version AND n.version < h.deleted_version)
+		)
+		WHERE (version, key, type) > (?, ?, ?)
+		ORDER BY version, key, type
+		LIMIT ?`)
+	v.getAtOrBeforeStmt = p.prepareRead(`SELECT object FROM object_history
+		WHERE key = ? AND version = (SELECT MAX(version) FROM object_history WHERE key = ? AND version <= ?)
+			AND (deleted_version IS NULL OR deleted_version > ?)`)
+	if p.err != nil {
+		return nil, p.err
+	}
+
+	o := buildOptions(opts)
+	if o.retentionPolicy != nil {
+		v.gc, err = newGarbageCollector(v, *o.retentionPolicy)
+		if err != nil {
+			return nil, err
+		}
+		if o.retentionPolicy.Interval > 0 {
+			v.gc.start()
+		}
+	}
 
 	return v, nil
 }
@@ -64,16 +143,67 @@ func (v *VersionedIndexer) AfterUpsert(key string, obj any, tx *sql.Tx) error {
 	if err != nil {
 		return err
 	}
-	_, err = tx.Stmt(v.addHistoryStmt).Exec(key, version, key)
+	_, err = tx.Stmt(v.addHistoryStmt).Exec(key, version, v.now().Unix(), key)
 	return err
 }
 
-// AfterDelete updates the deleted flag on the history table
-func (v *VersionedIndexer) AfterDelete(key string, tx *sql.Tx) error {
-	_, err := tx.Stmt(v.deleteHistoryStmt).Exec(key)
+// AfterDelete marks all versions of key as deleted at the version of the deletion, that is:
+//   - resourceVersion, if the deletion comes from a Replace at that resourceVersion
+//   - the version of obj, if it is the final state of the object (as in watch DELETED events)
+//   - otherwise, a best guess: the latest version or deletion version stored for any key, or the version
+//     following the latest version of key, whichever is greater
+func (v *VersionedIndexer) AfterDelete(key string, obj any, resourceVersion string, tx *sql.Tx) error {
+	var latestVersion, maxVersion int
+	err := tx.Stmt(v.latestVersionsStmt).QueryRow(key).Scan(&latestVersion, &maxVersion)
+	if err != nil {
+		return err
+	}
+
+	version, known, err := v.deletionVersion(obj, resourceVersion)
+	if err != nil {
+		return err
+	}
+	// a deletion always happens after the latest version
+	if !known || version <= latestVersion {
+		version = maxVersion
+		if version <= latestVersion {
+			version = latestVersion + 1
+		}
+	}
+
+	_, err = tx.Stmt(v.deleteHistoryStmt).Exec(version, v.now().Unix(), key)
 	return err
 }
 
+// deletionVersion returns the version at which an object was deleted, if known. See AfterDelete
+func (v *VersionedIndexer) deletionVersion(obj any, resourceVersion string) (int, bool, error) {
+	if resourceVersion != "" {
+		version, err := strconv.Atoi(resourceVersion)
+		if err == nil {
+			return version, true, nil
+		}
+	}
+	if _, ok := obj.(cache.DeletedFinalStateUnknown); obj == nil || ok {
+		return 0, false, nil
+	}
+	version, err := v.versionFunc(obj)
+	if err != nil {
+		return 0, false, err
+	}
+	return version, true, nil
+}
+
+// IsUnchanged returns true if obj's version is the latest stored for key, so that it can be skipped during replace
+func (v *VersionedIndexer) IsUnchanged(key string, obj any, tx *sql.Tx) (bool, error) {
+	version, err := v.versionFunc(obj)
+	if err != nil {
+		return false, err
+	}
+	var count int
+	err = tx.Stmt(v.isLatestStmt).QueryRow(key, version, key).Scan(&count)
+	return count > 0, err
+}
+
 // GetByKeyAndVersion returns the object associated with the given object's key and (exact) version
 func (v *VersionedIndexer) GetByKeyAndVersion(key string, version int) (item any, exists bool, err error) {
 	result, err := v.QueryObjects(v.getByVersionStmt, key, version, version)
@@ -87,3 +217,12 @@ func (v *VersionedIndexer) GetByKeyAndVersion(key string, version int) (item any
 
 	return result[0], true, nil
 }
+
+// Close stops the garbage collector, if running, and all watchers, then closes the underlying Store
+func (v *VersionedIndexer) Close() error {
+	if v.gc != nil {
+		v.gc.stop()
+	}
+	v.stopWatchers()
+	return v.Indexer.Close()
+}
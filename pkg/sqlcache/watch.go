@@ -0,0 +1,220 @@
+package sqlcache
+
+import (
+	"context"
+	"database/sql"
+	"github.com/pkg/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"strconv"
+	"sync"
+)
+
+// historyWatcher is a watch.Interface replaying events from object_history, see Watch
+type historyWatcher struct {
+	v      *VersionedIndexer
+	result chan watch.Event
+	// notify is signaled when new events might have been committed
+	notify chan struct{}
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// watchPageSize is the maximum number of events read from the database at once by a watcher
+const watchPageSize = 100
+
+// historyEvent identifies an event, to avoid sending it twice, and its position in version order
+type historyEvent struct {
+	version   int
+	key       string
+	eventType watch.EventType
+}
+
+// Watch returns a watch.Interface sending all events after fromVersion, in version order, then new events as they
+// are stored. Events are synthesized from stored versions: ADDED for the first version of an object (or the first
+// after its deletion), MODIFIED for subsequent versions and DELETED at the deletion version, with the last stored
+// version of the object. Stored objects must implement runtime.Object.
+// If history after fromVersion was deleted by the garbage collector, an error satisfying apierrors.IsResourceExpired
+// is returned
+func (v *VersionedIndexer) Watch(fromVersion int) (watch.Interface, error) {
+	err := v.checkNotCompacted(context.Background(), fromVersion, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &historyWatcher{
+		v:      v,
+		result: make(chan watch.Event),
+		notify: make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+	}
+	v.watchersLock.Lock()
+	v.watchers[w] = struct{}{}
+	v.watchersWait.Add(1)
+	v.watchersLock.Unlock()
+
+	go w.run(fromVersion)
+	return w, nil
+}
+
+// ResultChan returns the channel events are sent to
+func (w *historyWatcher) ResultChan() <-chan watch.Event {
+	return w.result
+}
+
+// Stop stops sending events and closes the result channel
+func (w *historyWatcher) Stop() {
+	w.stopOnce.Do(func() {
+		close(w.stop)
+	})
+}
+
+// run sends events until stopped, in pages of watchPageSize. Since later writes can only add events at or after
+// the latest version stored, after sending all events up to version, only events at or after it are queried again,
+// skipping those already sent. Each time, history after the last event sent is checked not to be garbage collected
+func (w *historyWatcher) run(fromVersion int) {
+	defer func() {
+		w.v.watchersLock.Lock()
+		delete(w.v.watchers, w)
+		w.v.watchersLock.Unlock()
+		close(w.result)
+		w.v.watchersWait.Done()
+	}()
+
+	lastSent := fromVersion
+	version := fromVersion + 1
+	sent := map[historyEvent]bool{}
+	for {
+		err := w.v.checkNotCompacted(context.Background(), lastSent, nil)
+		if err != nil {
+			w.sendError(err)
+			return
+		}
+
+		after := historyEvent{version: version}
+		for {
+			events, err := w.v.queryEvents(after, watchPageSize)
+			if err != nil {
+				w.sendError(err)
+				return
+			}
+			for _, event := range events {
+				after = event.historyEvent
+				if sent[event.historyEvent] {
+					continue
+				}
+				if event.version > version {
+					version = event.version
+					sent = map[historyEvent]bool{}
+				}
+				sent[event.historyEvent] = true
+
+				select {
+				case w.result <- event.Event:
+					lastSent = event.version
+				case <-w.stop:
+					return
+				}
+			}
+			if len(events) < watchPageSize {
+				break
+			}
+		}
+
+		select {
+		case <-w.notify:
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+// sendError sends err as an Error event, unless stopped. Kubernetes API errors, such as ResourceExpired, are sent
+// with their own status
+func (w *historyWatcher) sendError(err error) {
+	var status metav1.Status
+	var apiStatus apierrors.APIStatus
+	if errors.As(err, &apiStatus) {
+		status = apiStatus.Status()
+	} else {
+		status = apierrors.NewInternalError(err).Status()
+	}
+	select {
+	case w.result <- watch.Event{Type: watch.Error, Object: &status}:
+	case <-w.stop:
+	}
+}
+
+// versionedEvent is a watch.Event along with its identity
+type versionedEvent struct {
+	historyEvent
+	watch.Event
+}
+
+// queryEvents returns at most limit events after the one identified by after, in (version, key, type) order
+func (v *VersionedIndexer) queryEvents(after historyEvent, limit int) ([]versionedEvent, error) {
+	rows, err := v.listEventsStmt.Query(after.version, after.version, after.version, after.key, after.eventType, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := []versionedEvent{}
+	for rows.Next() {
+		var event versionedEvent
+		var buf sql.RawBytes
+		err = rows.Scan(&event.version, &event.key, &event.eventType, &buf)
+		if err != nil {
+			return nil, err
+		}
+		obj, err := v.fromBytes(buf)
+		if err != nil {
+			return nil, err
+		}
+		object, ok := obj.(runtime.Object)
+		if !ok {
+			return nil, errors.Errorf("Unexpected object does not conform to runtime.Object: %v", obj)
+		}
+		// deleted objects carry the deletion version, as in Kubernetes
+		if event.eventType == watch.Deleted {
+			accessor, err := meta.Accessor(object)
+			if err == nil {
+				accessor.SetResourceVersion(strconv.Itoa(event.version))
+			}
+		}
+		event.Event = watch.Event{Type: event.eventType, Object: object}
+		result = append(result, event)
+	}
+	return result, rows.Err()
+}
+
+// notifyWatchers signals all watchers that new events might have been stored
+func (v *VersionedIndexer) notifyWatchers() {
+	v.watchersLock.Lock()
+	defer v.watchersLock.Unlock()
+	for w := range v.watchers {
+		select {
+		case w.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// stopWatchers stops all watchers, waiting for them to terminate
+func (v *VersionedIndexer) stopWatchers() {
+	v.watchersLock.Lock()
+	watchers := []*historyWatcher{}
+	for w := range v.watchers {
+		watchers = append(watchers, w)
+	}
+	v.watchersLock.Unlock()
+
+	for _, w := range watchers {
+		w.Stop()
+	}
+	v.watchersWait.Wait()
+}
@@ -0,0 +1,150 @@
+package sqlcache
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"testing"
+	"time"
+)
+
+// testWatchEvents receives n events from w, returning their types, names and resourceVersions
+func testWatchEvents(t *testing.T, w watch.Interface, n int) []string {
+	result := []string{}
+	for i := 0; i < n; i++ {
+		select {
+		case event := <-w.ResultChan():
+			pod := event.Object.(*v1.Pod)
+			result = append(result, string(event.Type)+" "+pod.Name+" "+pod.ResourceVersion)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for event %d, got %v", i, result)
+		}
+	}
+	return result
+}
+
+func TestWatch(t *testing.T) {
+	assert := assert.New(t)
+
+	l, err := NewListOptionIndexer(&v1.Pod{}, TEST_DB_LOCATION, fieldFunc, WithRetentionPolicy(RetentionPolicy{MaxVersionsPerKey: 1}))
+	assert.NoError(err)
+	pod := func(name string, revision string) *v1.Pod {
+		return &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name, ResourceVersion: revision}}
+	}
+
+	assert.NoError(l.Add(pod("red", "1")))
+	assert.NoError(l.Add(pod("blue", "2")))
+	assert.NoError(l.Update(pod("red", "3")))
+	assert.NoError(l.Delete(pod("blue", "4")))
+
+	// past events are replayed
+	w, err := l.Watch(0)
+	assert.NoError(err)
+	assert.Equal([]string{
+		"ADDED red 1",
+		"ADDED blue 2",
+		"MODIFIED red 3",
+		"DELETED blue 4",
+	}, testWatchEvents(t, w, 4))
+
+	// then new events are sent as they are stored
+	w2, err := l.Watch(3)
+	assert.NoError(err)
+	assert.Equal([]string{"DELETED blue 4"}, testWatchEvents(t, w2, 1))
+
+	assert.NoError(l.Add(pod("yellow", "5")))
+	assert.NoError(l.Add(pod("blue", "6")))
+	assert.NoError(l.Replace([]any{pod("blue", "6")}, "7"))
+	expected := []string{
+		"ADDED yellow 5",
+		"ADDED blue 6",
+		"DELETED red 7",
+		"DELETED yellow 7",
+	}
+	assert.Equal(expected, testWatchEvents(t, w, 4))
+	assert.Equal(expected, testWatchEvents(t, w2, 4))
+
+	// stopping closes the result channel
+	w.Stop()
+	_, ok := <-w.ResultChan()
+	assert.False(ok)
+
+	// watching from garbage collected history fails
+	_, err = l.CollectGarbage(context.Background())
+	assert.NoError(err)
+	_, err = l.Watch(3)
+	assert.True(apierrors.IsResourceExpired(err))
+	w, err = l.Watch(7)
+	assert.NoError(err)
+
+	// closing stops all watchers
+	assert.NoError(l.Close())
+	_, ok = <-w.ResultChan()
+	assert.False(ok)
+	_, ok = <-w2.ResultChan()
+	assert.False(ok)
+}
+
+func TestWatchPages(t *testing.T) {
+	assert := assert.New(t)
+
+	l, err := NewListOptionIndexer(&v1.Pod{}, TEST_DB_LOCATION, fieldFunc)
+	assert.NoError(err)
+	expected := []string{}
+	for i := 1; i <= 2*watchPageSize+10; i++ {
+		name := fmt.Sprintf("pod%d", i)
+		assert.NoError(l.Add(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name, ResourceVersion: fmt.Sprint(i)}}))
+		expected = append(expected, fmt.Sprintf("ADDED %s %d", name, i))
+	}
+
+	w, err := l.Watch(0)
+	assert.NoError(err)
+	assert.Equal(expected, testWatchEvents(t, w, len(expected)))
+
+	assert.NoError(l.Close())
+}
+
+func TestWatchCompaction(t *testing.T) {
+	assert := assert.New(t)
+
+	l, err := NewListOptionIndexer(&v1.Pod{}, TEST_DB_LOCATION, fieldFunc, WithRetentionPolicy(RetentionPolicy{MaxVersionsPerKey: 1}))
+	assert.NoError(err)
+	pod := func(name string, revision string) *v1.Pod {
+		return &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name, ResourceVersion: revision}}
+	}
+	assert.NoError(l.Add(pod("red", "1")))
+	assert.NoError(l.Add(pod("blue", "2")))
+
+	// once the first event is received, all events up to version 2 were read
+	w, err := l.Watch(0)
+	assert.NoError(err)
+	assert.Equal([]string{"ADDED red 1"}, testWatchEvents(t, w, 1))
+
+	// history the watcher did not send yet is garbage collected
+	assert.NoError(l.Update(pod("red", "3")))
+	assert.NoError(l.Update(pod("red", "4")))
+	_, err = l.CollectGarbage(context.Background())
+	assert.NoError(err)
+
+	// events already read are sent, then the watcher fails
+	assert.Equal([]string{"ADDED blue 2"}, testWatchEvents(t, w, 1))
+	select {
+	case event := <-w.ResultChan():
+		assert.Equal(watch.Error, event.Type)
+		assert.True(apierrors.IsResourceExpired(apierrors.FromObject(event.Object)))
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for error event")
+	}
+	select {
+	case _, ok := <-w.ResultChan():
+		assert.False(ok)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the result channel to be closed")
+	}
+
+	assert.NoError(l.Close())
+}